@@ -5,11 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
 	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
 	"github.com/InteractivePlus/InteractiveSSO-Go/user"
 )
@@ -23,8 +25,17 @@ type API struct {
 	HttpClient *http.Client
 	Timeout    time.Duration
 	APIServer  string
-	o          *oauth.OAuth
-	u          *user.User
+	//nil means a single attempt per request
+	Retry *RetryPolicy
+	//Applied in order around every attempt, see Middleware
+	Middleware []Middleware
+	//Optional, handed to the OAuth and User created by this API
+	Tokens common.TokenStore
+
+	clientsMu sync.RWMutex
+	clients   map[string]*oauth.OAuth
+	userOnce  sync.Once
+	u         *user.User
 }
 
 //Usage
@@ -35,130 +46,157 @@ func (a *API) GetFormatURL(QueryString string) string {
 	return fmt.Sprintf("%s%s", a.APIServer, QueryString)
 }
 
+//ParseURLWithParams appends params to URL as an escaped query string.
+//Values come from callers and tokens, a raw "&" or "=" in them must not turn into another parameter.
 func (a *API) ParseURLWithParams(URL string, params map[string]string) string {
-	genStringSlice := []string{}
-	var genString string
-
+	q := url.Values{}
 	for k, v := range params {
-		genString = k + "=" + v
-		genStringSlice = append(genStringSlice, genString)
+		q.Set(k, v)
+	}
+	sep := "?"
+	if strings.Contains(URL, "?") {
+		sep = "&"
 	}
-	return fmt.Sprintf("%s%s?%s", a.APIServer, URL, strings.Join(genStringSlice, "&"))
+	return fmt.Sprintf("%s%s%s%s", a.APIServer, URL, sep, q.Encode())
 }
 
-//access the url using GET Method
-func (a *API) GetURL(URL string) ([]byte, string, error) {
-	req, err := http.NewRequest("GET", a.GetFormatURL(URL), nil)
-	if err != nil {
-		return nil, "", err
+//Context returns the default context for calls that don't bring their own
+func (a *API) Context() context.Context {
+	if a.Ctx == nil {
+		return context.Background()
 	}
-	ctx, cancel := context.WithTimeout(a.Ctx, a.Timeout)
-	defer cancel()
-	res, err := a.HttpClient.Do(req.WithContext(ctx))
+	return a.Ctx
+}
+
+//do performs req, retrying it according to a.Retry.
+//a.Timeout only applies if ctx has no deadline of its own.
+//Any non-2xx status comes back as an error, see common.StatusError
+func (a *API) do(ctx context.Context, URL string, req *http.Request) ([]byte, int, error) {
+	path := strings.SplitN(URL, "?", 2)[0]
+	if _, ok := ctx.Deadline(); !ok && a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		body, status, header, err := a.roundTrip(ctx, path, req)
+		if err == nil || a.Retry == nil || attempt >= a.Retry.MaxAttempts || ctx.Err() != nil {
+			return body, status, err
+		}
+		if !a.Retry.shouldRetry(req.Method, status, err) || !sleep(ctx, a.Retry.delay(attempt, header)) {
+			return body, status, err
+		}
+	}
+}
+
+func (a *API) roundTrip(ctx context.Context, path string, req *http.Request) ([]byte, int, http.Header, error) {
+	req = req.Clone(ctx)
+	if req.GetBody != nil {
+		//The body of the previous attempt has been consumed already
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		req.Body = b
+	}
+	res, err := a.chain()(&Request{
+		Path: path,
+		HTTP: req,
+	})
 	if err != nil {
-		return nil, "", err
+		return nil, 0, nil, err
+	}
+	if res.HTTP.StatusCode < 200 || res.HTTP.StatusCode > 299 {
+		return res.Body, res.HTTP.StatusCode, res.HTTP.Header, common.StatusError(res.HTTP.StatusCode, res.Body)
 	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	return body, res.Status, nil
+	return res.Body, res.HTTP.StatusCode, res.HTTP.Header, nil
 }
 
-func (a *API) GetURLWithParams(URL string, params map[string]string) ([]byte, string, error) {
-	req, err := http.NewRequest("GET", a.ParseURLWithParams(URL, params), nil)
+//access the url using GET Method
+func (a *API) GetURL(URL string) ([]byte, int, error) {
+	return a.GetURLContext(a.Context(), URL)
+}
+
+func (a *API) GetURLContext(ctx context.Context, URL string) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", a.GetFormatURL(URL), nil)
 	if err != nil {
-		return nil, "", err
+		return nil, 0, err
 	}
-	ctx, cancel := context.WithTimeout(a.Ctx, a.Timeout)
-	defer cancel()
-	res, err := a.HttpClient.Do(req.WithContext(ctx))
+	return a.do(ctx, URL, req)
+}
+
+func (a *API) GetURLWithParams(URL string, params map[string]string) ([]byte, int, error) {
+	return a.GetURLWithParamsContext(a.Context(), URL, params)
+}
+
+func (a *API) GetURLWithParamsContext(ctx context.Context, URL string, params map[string]string) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", a.ParseURLWithParams(URL, params), nil)
 	if err != nil {
-		return nil, "", err
+		return nil, 0, err
 	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	return body, res.Status, nil
+	return a.do(ctx, URL, req)
 }
 
 //access the url using POST method
-// Return Value : Response Body, HTTP Code, Error
-func (a *API) PostURL(URL string, Value interface{}) ([]byte, string, error) {
-	payload, _ := json.Marshal(Value)
-	req, err := http.NewRequest("POST", a.GetFormatURL(URL), bytes.NewBuffer(payload))
-	req.Header.Set("Content-Type", "application/json")
+// Return Value : Response Body, HTTP Status Code, Error
+func (a *API) PostURL(URL string, Value interface{}) ([]byte, int, error) {
+	return a.PostURLContext(a.Context(), URL, Value)
+}
 
+func (a *API) PostURLContext(ctx context.Context, URL string, Value interface{}) ([]byte, int, error) {
+	payload, err := json.Marshal(Value)
 	if err != nil {
-		return nil, "", err
+		return nil, 0, err
 	}
-	ctx, cancel := context.WithTimeout(a.Ctx, a.Timeout)
-	defer cancel()
-	res, err := a.HttpClient.Do(req.WithContext(ctx))
+	req, err := http.NewRequest("POST", a.GetFormatURL(URL), bytes.NewBuffer(payload))
 	if err != nil {
-		return nil, "", err
+		return nil, 0, err
 	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	return body, res.Status, nil
+	req.Header.Set("Content-Type", "application/json")
+	return a.do(ctx, URL, req)
 }
 
-func (a *API) PatchURL(URL string, Value interface{}) ([]byte, string, error) {
-	jsonBlob, _ := json.Marshal(Value)
+func (a *API) PatchURL(URL string, Value interface{}) ([]byte, int, error) {
+	return a.PatchURLContext(a.Context(), URL, Value)
+}
+
+func (a *API) PatchURLContext(ctx context.Context, URL string, Value interface{}) ([]byte, int, error) {
+	jsonBlob, err := json.Marshal(Value)
+	if err != nil {
+		return nil, 0, err
+	}
 	//Patch Params MUST BE an array
 	payload := []byte(`[`)
 	end := []byte(`]`)
 	payload = append(payload, jsonBlob...)
 	payload = append(payload, end...)
 	req, err := http.NewRequest("PATCH", a.GetFormatURL(URL), bytes.NewBuffer(payload))
-	req.Header.Set("Content-Type", "application/json")
-
 	if err != nil {
-		return nil, "", err
+		return nil, 0, err
 	}
-	ctx, cancel := context.WithTimeout(a.Ctx, a.Timeout)
-	defer cancel()
-	res, err := a.HttpClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return nil, "", err
-	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	return body, res.Status, nil
+	req.Header.Set("Content-Type", "application/json")
+	return a.do(ctx, URL, req)
 }
 
-func (a *API) DeleteURL(URL string) ([]byte, string, error) {
-	req, err := http.NewRequest("DELETE", a.GetFormatURL(URL), nil)
-	if err != nil {
-		return nil, "", err
-	}
-	ctx, cancel := context.WithTimeout(a.Ctx, a.Timeout)
-	defer cancel()
-	res, err := a.HttpClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return nil, "", err
-	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	return body, res.Status, nil
+func (a *API) DeleteURL(URL string) ([]byte, int, error) {
+	return a.DeleteURLContext(a.Context(), URL)
 }
 
-func (a *API) OAuth(ClientID string) *oauth.OAuth {
-	if a.o == nil {
-		//Cache it for the first time
-		a.o = &oauth.OAuth{
-			Token: &oauth.OAuthToken{
-				ClientID: ClientID,
-			},
-			API: a,
-		}
+func (a *API) DeleteURLContext(ctx context.Context, URL string) ([]byte, int, error) {
+	req, err := http.NewRequest("DELETE", a.GetFormatURL(URL), nil)
+	if err != nil {
+		return nil, 0, err
 	}
-	return a.o
+	return a.do(ctx, URL, req)
 }
 
 func (a *API) User() *user.User {
-	if a.u == nil {
+	a.userOnce.Do(func() {
 		//Cache it for the first time
 		a.u = &user.User{
-			API: a,
+			API:   a,
+			Store: a.Tokens,
 		}
-	}
+	})
 	return a.u
 }
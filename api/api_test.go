@@ -0,0 +1,35 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+)
+
+func TestGetURLWithParamsEscapes(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		w.Write([]byte(`{"errorCode":0}`))
+	}))
+	defer srv.Close()
+	a := &api.API{
+		HttpClient: srv.Client(),
+		APIServer:  srv.URL,
+	}
+
+	//A token smuggling in a parameter of its own
+	params := map[string]string{
+		"access_token": "abc&client_id=other",
+		"client_id":    "app",
+	}
+	if _, _, err := a.GetURLWithParams("/oauth_token/verified_status", params); err != nil {
+		t.Fatalf("GetURLWithParams: %v", err)
+	}
+	if len(got) != 2 || got.Get("access_token") != params["access_token"] || got.Get("client_id") != "app" {
+		t.Fatalf("server got %v, want %v", got, params)
+	}
+}
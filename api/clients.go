@@ -0,0 +1,80 @@
+package api
+
+import (
+	"sort"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+//RegisterClient adds c to the clients of a. A c without Store gets a.Tokens.
+//Registering a ClientID again reconfigures its OAuth in place, so the *oauth.OAuth
+//handed out before keeps working with the new configuration.
+func (a *API) RegisterClient(c oauth.ClientConfig) error {
+	if c.ClientID == "" {
+		return common.ParamsError
+	}
+	if c.Store == nil {
+		c.Store = a.Tokens
+	}
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+	if o, ok := a.clients[c.ClientID]; ok {
+		return o.Configure(c)
+	}
+	if a.clients == nil {
+		a.clients = map[string]*oauth.OAuth{}
+	}
+	a.clients[c.ClientID] = oauth.NewClient(a, c)
+	return nil
+}
+
+//Client returns the configuration registered for ClientID
+func (a *API) Client(ClientID string) (oauth.ClientConfig, bool) {
+	a.clientsMu.RLock()
+	defer a.clientsMu.RUnlock()
+	o, ok := a.clients[ClientID]
+	if !ok {
+		return oauth.ClientConfig{}, false
+	}
+	return o.Config(), true
+}
+
+//ClientIDs lists the registered clients in order
+func (a *API) ClientIDs() []string {
+	a.clientsMu.RLock()
+	defer a.clientsMu.RUnlock()
+	ret := make([]string, 0, len(a.clients))
+	for k := range a.clients {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//OAuth returns the OAuth of ClientID, one per client.
+//A ClientID that wasn't registered gets a registration with nothing but the ClientID and a.Tokens.
+func (a *API) OAuth(ClientID string) *oauth.OAuth {
+	a.clientsMu.RLock()
+	o, ok := a.clients[ClientID]
+	a.clientsMu.RUnlock()
+	if ok {
+		return o
+	}
+
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+	//Somebody may have been faster
+	if o, ok := a.clients[ClientID]; ok {
+		return o
+	}
+	if a.clients == nil {
+		a.clients = map[string]*oauth.OAuth{}
+	}
+	o = oauth.NewClient(a, oauth.ClientConfig{
+		ClientID: ClientID,
+		Store:    a.Tokens,
+	})
+	a.clients[ClientID] = o
+	return o
+}
@@ -0,0 +1,119 @@
+package api_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+func TestRegisterClientKeepsInstance(t *testing.T) {
+	srv := ssotest.NewServer()
+	defer srv.Close()
+	a := srv.API()
+
+	if err := a.RegisterClient(oauth.ClientConfig{ClientID: "app", ClientSecret: "old"}); err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	o := a.OAuth("app")
+	if err := a.RegisterClient(oauth.ClientConfig{ClientID: "app", ClientSecret: "new"}); err != nil {
+		t.Fatalf("RegisterClient again: %v", err)
+	}
+	if a.OAuth("app") != o {
+		t.Fatal("registering again replaced the OAuth of the client")
+	}
+	if c := o.Config(); c.ClientSecret != "new" {
+		t.Fatalf("OAuth has secret %q after registering again, want new", c.ClientSecret)
+	}
+	if c, ok := a.Client("app"); !ok || c.ClientSecret != "new" {
+		t.Fatalf("Client returned %+v, %v", c, ok)
+	}
+}
+
+func TestRegisteredSecretIsUsed(t *testing.T) {
+	srv := ssotest.NewServer()
+	defer srv.Close()
+	srv.AddClient("app", "s3cret")
+	srv.AddUser(user.UserEntity{UID: 1, Username: "alice"}, "secret")
+	srv.AddMask(user.MaskIDEntity{MaskId: "m1", ClientID: "app", UID: 1})
+	a := srv.API()
+	if err := a.RegisterClient(oauth.ClientConfig{ClientID: "app", ClientSecret: "s3cret"}); err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	o := a.OAuth("app")
+
+	code := srv.IssueAuthCode("app", "m1", []string{"info"}, "", "")
+	token, err := o.NewSession().Exchange(a.Context(), code, "")
+	if err != nil {
+		t.Fatalf("Exchange without passing the secret: %v", err)
+	}
+	if _, err := oauth.NewVerifyCache(o, "").Verify(a.Context(), token.AccessToken); err != nil {
+		t.Fatalf("Verify without passing the secret: %v", err)
+	}
+
+	//Verification and refresh send the secret too, a wrong one must make them fail
+	if err := a.RegisterClient(oauth.ClientConfig{ClientID: "app", ClientSecret: "wrong"}); err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	if _, err := oauth.NewVerifyCache(o, "").Verify(a.Context(), token.AccessToken); !errors.Is(err, oauth.ErrInvalidBearerToken) {
+		t.Fatalf("Verify with a wrong registered secret: got %v, want ErrInvalidBearerToken", err)
+	}
+	expired := *token
+	expired.Expires = 1
+	if _, err := oauth.NewTokenSource(o, &expired, "").Token(a.Context()); err == nil {
+		t.Fatal("refresh with a wrong registered secret succeeded")
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	srv := ssotest.NewServer()
+	defer srv.Close()
+	srv.AddClient("app", "s3cret")
+	for i := 1; i <= 8; i++ {
+		srv.AddUser(user.UserEntity{UID: i, Username: fmt.Sprintf("user%d", i)}, "secret")
+		srv.AddMask(user.MaskIDEntity{MaskId: fmt.Sprintf("m%d", i), ClientID: "app", UID: i})
+	}
+	a := srv.API()
+
+	//Flows on the lazily created OAuth run while the client gets registered over and over
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := a.RegisterClient(oauth.ClientConfig{ClientID: "app", ClientSecret: "s3cret"}); err != nil {
+				t.Errorf("RegisterClient: %v", err)
+			}
+			a.Client("app")
+			a.ClientIDs()
+		}()
+		go func(MaskID string) {
+			defer wg.Done()
+			code := srv.IssueAuthCode("app", MaskID, []string{"info"}, "", "")
+			s := a.OAuth("app").NewSession()
+			if _, err := s.Exchange(a.Context(), code, "s3cret"); err != nil {
+				t.Errorf("%s: Exchange: %v", MaskID, err)
+				return
+			}
+			if info, err := s.UserInfo(a.Context()); err != nil || info.MaskID != MaskID {
+				t.Errorf("%s: UserInfo: %+v, %v", MaskID, info, err)
+				return
+			}
+			if _, err := s.Refresh(a.Context()); err != nil {
+				t.Errorf("%s: Refresh: %v", MaskID, err)
+			}
+		}(fmt.Sprintf("m%d", i))
+	}
+	wg.Wait()
+
+	if ids := a.ClientIDs(); len(ids) != 1 || ids[0] != "app" {
+		t.Fatalf("ClientIDs returned %v, want [app]", ids)
+	}
+	if c, _ := a.Client("app"); c.ClientSecret != "s3cret" {
+		t.Fatalf("Client has secret %q, want s3cret", c.ClientSecret)
+	}
+}
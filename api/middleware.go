@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+//Request is one attempt of an SSO call as seen by a Middleware
+type Request struct {
+	//Endpoint path without APIServer and query string, e.g. /user/token
+	Path string
+	HTTP *http.Request
+}
+
+//Response is what came back for a Request. HTTP.Body has been read into Body already.
+type Response struct {
+	HTTP *http.Response
+	Body []byte
+	//nil if Body isn't a GeneralResult envelope
+	Result *common.GeneralResult
+}
+
+type RoundTripFunc func(req *Request) (*Response, error)
+
+//Middleware wraps a round trip, the first one in API.Middleware is the outermost.
+//It runs once per attempt, so retried calls pass through it again.
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+func (a *API) chain() RoundTripFunc {
+	next := a.send
+	for i := len(a.Middleware) - 1; i >= 0; i-- {
+		next = a.Middleware[i](next)
+	}
+	return next
+}
+
+func (a *API) send(req *Request) (*Response, error) {
+	res, err := a.HttpClient.Do(req.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Response{
+		HTTP: res,
+		Body: body,
+	}
+	var result common.GeneralResult
+	if err := json.Unmarshal(body, &result); err == nil {
+		ret.Result = &result
+	}
+	return ret, nil
+}
+
+//secretAfter maps a path segment to the name logged instead of the segment following it
+var secretAfter = map[string]string{
+	"token":             "{access_token}",
+	"verifyEmailResult": "{veri_code}",
+	"verifyPhoneResult": "{veri_code}",
+}
+
+//redactPath replaces the access tokens and verification codes in path with placeholders,
+//e.g. /user/1/token/abc/checkTokenResult becomes /user/1/token/{access_token}/checkTokenResult
+func redactPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		name, ok := secretAfter[segments[i-1]]
+		//refreshResult is an endpoint of its own, the refresh token is in the query
+		if ok && segments[i] != "" && segments[i] != "refreshResult" {
+			segments[i] = name
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+//LoggingMiddleware logs method, path, status, errorCode and duration of every attempt.
+//Query strings are left out and access tokens and verification codes in the path are
+//replaced with placeholders, so the log carries no credentials.
+//A nil logger means log.Default()
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *Request) (*Response, error) {
+			start := time.Now()
+			res, err := next(req)
+			elapsed := time.Since(start)
+			path := redactPath(req.Path)
+			if err != nil {
+				logger.Printf("interactivesso: %s %s failed after %s: %v", req.HTTP.Method, path, elapsed, err)
+				return res, err
+			}
+			if res.Result != nil {
+				logger.Printf("interactivesso: %s %s %d errorCode=%d in %s", req.HTTP.Method, path, res.HTTP.StatusCode, res.Result.ErrCode, elapsed)
+			} else {
+				logger.Printf("interactivesso: %s %s %d in %s", req.HTTP.Method, path, res.HTTP.StatusCode, elapsed)
+			}
+			return res, err
+		}
+	}
+}
+
+//HeaderMiddleware sets header on every request, replacing values of the same key
+func HeaderMiddleware(header http.Header) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *Request) (*Response, error) {
+			for k, v := range header {
+				req.HTTP.Header.Del(k)
+				for _, vv := range v {
+					req.HTTP.Header.Add(k, vv)
+				}
+			}
+			return next(req)
+		}
+	}
+}
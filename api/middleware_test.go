@@ -0,0 +1,57 @@
+package api_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+)
+
+func TestLoggingMiddlewareRedactsSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errorCode":0}`))
+	}))
+	defer srv.Close()
+	var buf bytes.Buffer
+	a := &api.API{
+		HttpClient: srv.Client(),
+		APIServer:  srv.URL,
+		Middleware: []api.Middleware{api.LoggingMiddleware(log.New(&buf, "", 0))},
+	}
+
+	const secret = "s3cr3tvalue"
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/user/1/token/" + secret + "/checkTokenResult", "/user/1/token/{access_token}/checkTokenResult"},
+		{"DELETE", "/user/1/token/" + secret, "/user/1/token/{access_token}"},
+		{"GET", "/vericodes/verifyEmailResult/" + secret, "/vericodes/verifyEmailResult/{veri_code}"},
+		{"GET", "/vericodes/verifyPhoneResult/" + secret + "?uid=1", "/vericodes/verifyPhoneResult/{veri_code}"},
+		{"GET", "/user/1/token/refreshResult?refresh_token=" + secret, "/user/1/token/refreshResult"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		var err error
+		if tt.method == "DELETE" {
+			_, _, err = a.DeleteURL(tt.path)
+		} else {
+			_, _, err = a.GetURL(tt.path)
+		}
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		logged := buf.String()
+		if strings.Contains(logged, secret) {
+			t.Errorf("%s %s logged the secret: %s", tt.method, tt.path, logged)
+		}
+		if !strings.Contains(logged, " "+tt.want+" ") {
+			t.Errorf("%s %s logged %q, want the path %s", tt.method, tt.path, logged, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+//RetryPolicy controls how often and when a failed request is sent again.
+//A nil policy on API means exactly one attempt.
+type RetryPolicy struct {
+	//Total number of attempts, including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//Jitter is the fraction (0 - 1) of every delay that gets randomized
+	Jitter float64
+	//HTTP status codes that are worth another attempt for GET and DELETE
+	RetryableStatus []int
+	//HTTP status codes after which a POST or PATCH is sent again.
+	//Only list codes that are answered before the request is acted upon: a 503 may come from
+	//a proxy or a server going down after the request was processed, replaying it could e.g.
+	//send a notification twice.
+	ReplayableStatus []int
+	//Network errors that are worth another attempt for GET and DELETE.
+	//POST and PATCH only retry when the connection was never established.
+	RetryableError func(err error) bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.2,
+		RetryableStatus: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		//Rate limiting rejects a request before it is processed
+		ReplayableStatus: []int{
+			http.StatusTooManyRequests,
+		},
+		RetryableError: IsTransientError,
+	}
+}
+
+//IsTransientError reports whether err looks like a network hiccup rather than a permanent failure
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsDialError(err) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+//IsDialError reports whether err is a failure to connect.
+//The request never left this machine, so replaying it is always safe.
+func IsDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func containsStatus(list []int, StatusCode int) bool {
+	for _, v := range list {
+		if v == StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+//StatusCode is 0 if the request failed before a response arrived
+func (p *RetryPolicy) shouldRetry(method string, StatusCode int, err error) bool {
+	if StatusCode == 0 {
+		if !isIdempotent(method) {
+			return IsDialError(err)
+		}
+		return p.RetryableError != nil && p.RetryableError(err)
+	}
+	if !isIdempotent(method) {
+		return containsStatus(p.ReplayableStatus, StatusCode)
+	}
+	return containsStatus(p.RetryableStatus, StatusCode)
+}
+
+//delay before attempt+1, a Retry-After header wins over the computed backoff
+func (p *RetryPolicy) delay(attempt int, header http.Header) time.Duration {
+	if d, ok := parseRetryAfter(header); ok {
+		return d
+	}
+	d := p.BaseDelay << uint(attempt-1)
+	if d < p.BaseDelay || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+//sleep waits for d, it gives up right away if ctx would expire before that
+func sleep(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//fakeTransport answers every request through answer and counts them
+type fakeTransport struct {
+	calls  int
+	answer func(req *http.Request) (*http.Response, error)
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	return f.answer(req)
+}
+
+func statusAnswer(StatusCode int, header http.Header) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			StatusCode: StatusCode,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errorCode":1}`)),
+			Request:    req,
+		}, nil
+	}
+}
+
+func errorAnswer(err error) func(*http.Request) (*http.Response, error) {
+	return func(*http.Request) (*http.Response, error) {
+		return nil, err
+	}
+}
+
+func testAPI(f *fakeTransport) *API {
+	p := DefaultRetryPolicy()
+	p.BaseDelay = time.Millisecond
+	p.MaxDelay = time.Millisecond
+	return &API{
+		HttpClient: &http.Client{Transport: f},
+		APIServer:  "http://sso.invalid",
+		Retry:      p,
+	}
+}
+
+func TestRetryDelayGrows(t *testing.T) {
+	p := &RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+	}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, w := range want {
+		if got := p.delay(i+1, nil); got != w {
+			t.Errorf("delay after attempt %d is %s, want %s", i+1, got, w)
+		}
+	}
+	//Shifting far enough overflows, that must not turn into a tiny delay
+	if got := p.delay(80, nil); got != time.Second {
+		t.Errorf("delay after attempt 80 is %s, want %s", got, time.Second)
+	}
+}
+
+func TestRetryJitterBounds(t *testing.T) {
+	p := &RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    0.2,
+	}
+	for i := 0; i < 1000; i++ {
+		if got := p.delay(1, nil); got < 80*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("jittered delay %s outside of [80ms, 100ms]", got)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("Retry-After", tt.value)
+		}
+		got, ok := parseRetryAfter(h)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	//A date in the future waits until then
+	h := http.Header{}
+	h.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got, ok := parseRetryAfter(h); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter of a date a minute ahead = %s, %v", got, ok)
+	}
+	//Retry-After wins over the backoff
+	p := &RetryPolicy{BaseDelay: time.Millisecond}
+	h.Set("Retry-After", "2")
+	if got := p.delay(1, h); got != 2*time.Second {
+		t.Errorf("delay with Retry-After 2 is %s, want 2s", got)
+	}
+}
+
+func TestRetryReplayRules(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	tests := []struct {
+		name   string
+		method string
+		answer func(*http.Request) (*http.Response, error)
+		calls  int
+	}{
+		{"GET 503", "GET", statusAnswer(http.StatusServiceUnavailable, nil), 3},
+		{"GET 429", "GET", statusAnswer(http.StatusTooManyRequests, nil), 3},
+		{"GET 400", "GET", statusAnswer(http.StatusBadRequest, nil), 1},
+		{"GET connection reset", "GET", errorAnswer(reset), 3},
+		{"DELETE 502", "DELETE", statusAnswer(http.StatusBadGateway, nil), 3},
+		{"POST 503", "POST", statusAnswer(http.StatusServiceUnavailable, nil), 1},
+		{"POST 502", "POST", statusAnswer(http.StatusBadGateway, nil), 1},
+		{"POST 429", "POST", statusAnswer(http.StatusTooManyRequests, nil), 3},
+		{"POST connection refused", "POST", errorAnswer(dial), 3},
+		{"POST connection reset", "POST", errorAnswer(reset), 1},
+		{"PATCH 503", "PATCH", statusAnswer(http.StatusServiceUnavailable, nil), 1},
+		{"PATCH 429", "PATCH", statusAnswer(http.StatusTooManyRequests, nil), 3},
+	}
+	for _, tt := range tests {
+		f := &fakeTransport{answer: tt.answer}
+		a := testAPI(f)
+		var err error
+		switch tt.method {
+		case "GET":
+			_, _, err = a.GetURL("/user")
+		case "DELETE":
+			_, _, err = a.DeleteURL("/user")
+		case "POST":
+			_, _, err = a.PostURL("/user", map[string]string{"a": "b"})
+		case "PATCH":
+			_, _, err = a.PatchURL("/user", map[string]string{"a": "b"})
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if f.calls != tt.calls {
+			t.Errorf("%s: %d attempts, want %d", tt.name, f.calls, tt.calls)
+		}
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	var bodies []string
+	f := &fakeTransport{}
+	f.answer = func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(b))
+		return statusAnswer(http.StatusTooManyRequests, nil)(req)
+	}
+	testAPI(f).PostURL("/user", map[string]string{"a": "b"})
+	if len(bodies) != 3 || bodies[0] == "" || bodies[1] != bodies[0] || bodies[2] != bodies[0] {
+		t.Fatalf("attempts sent bodies %q, want the same one three times", bodies)
+	}
+}
+
+func TestRetryStopsAtDeadline(t *testing.T) {
+	h := http.Header{}
+	h.Set("Retry-After", "10")
+	f := &fakeTransport{answer: statusAnswer(http.StatusServiceUnavailable, h)}
+	a := testAPI(f)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := a.GetURLContext(ctx, "/user")
+	if err == nil {
+		t.Fatal("no error")
+	}
+	//Waiting 10s would overshoot the deadline, so there is no point in waiting at all
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("gave up after %s, want right away", elapsed)
+	}
+	if f.calls != 1 {
+		t.Fatalf("%d attempts, want 1", f.calls)
+	}
+
+	//A context that ends while waiting ends the wait
+	f = &fakeTransport{answer: errorAnswer(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})}
+	a = testAPI(f)
+	a.Retry.BaseDelay, a.Retry.MaxDelay, a.Retry.MaxAttempts = time.Hour, time.Hour, 5
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if _, _, err := a.GetURLContext(ctx, "/user"); err == nil {
+		t.Fatal("no error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gave up after %s, want when the context ended", elapsed)
+	}
+	if f.calls != 1 {
+		t.Fatalf("%d attempts, want 1", f.calls)
+	}
+}
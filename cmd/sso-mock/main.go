@@ -0,0 +1,154 @@
+//Command sso-mock runs the emulated InteractiveSSO API of package ssotest on a local port,
+//so that frontends and backends can be developed offline against api.API.APIServer = "http://localhost:8080".
+//
+//Verification codes and notifications are printed to stdout instead of being sent.
+//
+//Usage:
+//
+//	sso-mock [-addr 127.0.0.1:8080] [-fixture seed.yaml] [-state state.json]
+//
+//The fixture (JSON or YAML) seeds users, OAuth clients and masks:
+//
+//	users:
+//	  - uid: 1
+//	    username: alice
+//	    password: secret
+//	    email: alice@example.com
+//	    emailVerified: true
+//	clients:
+//	  - client_id: demo
+//	    client_secret: demo-secret
+//	masks:
+//	  - mask_id: alice-demo
+//	    client_id: demo
+//	    uid: 1
+//	    display_name: Alice
+//
+//With -state the whole state is written to that file after every request and loaded
+//from it on startup, in which case the fixture is only applied if the file doesn't exist yet.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/internal/fileutil"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	fixture := flag.String("fixture", "", "JSON or YAML file with users, clients and masks to seed")
+	statePath := flag.String("state", "", "persist state to this JSON file")
+	flag.Parse()
+
+	b := ssotest.NewBackend()
+	b.OnVeriCode = func(v ssotest.VeriCode) {
+		fmt.Printf("[vericode] %s for uid %d to %s via %s: %s\n", v.Purpose, v.UID, v.Target, methodName(v.Method), v.Code)
+	}
+	b.OnNotification = func(n ssotest.Notification) {
+		fmt.Printf("[notification] mask %s (client %s) via %s, sales=%t\n  %s\n  %s\n", n.MaskID, n.ClientID, methodName(n.Method), n.IsSales, n.Title, n.Content)
+	}
+
+	loaded := false
+	if *statePath != "" {
+		var err error
+		if loaded, err = loadState(b, *statePath); err != nil {
+			log.Fatalf("sso-mock: load state: %v", err)
+		}
+	}
+	if *fixture != "" && !loaded {
+		f, err := readFixture(*fixture)
+		if err != nil {
+			log.Fatalf("sso-mock: read fixture: %v", err)
+		}
+		b.Seed(f)
+	}
+
+	var handler http.Handler = b
+	if *statePath != "" {
+		handler = persist(b, *statePath)
+	}
+	log.Printf("sso-mock: listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
+
+func methodName(Method int) string {
+	switch Method {
+	case common.EMAIL:
+		return "email"
+	case common.SMS_MESSAGE:
+		return "sms"
+	case common.PHONE_CALL:
+		return "phone call"
+	}
+	return "none"
+}
+
+//readFixture decodes YAML through JSON so the json tags of the entity types apply
+func readFixture(path string) (*ssotest.Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var f ssotest.Fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func loadState(b *ssotest.Backend, path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return true, b.Load(file)
+}
+
+//saveState writes to a temporary file first so a crash never leaves a truncated state behind
+func saveState(b *ssotest.Backend, path string) error {
+	var buf bytes.Buffer
+	if err := b.Save(&buf); err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(path, buf.Bytes(), 0600)
+}
+
+func persist(b *ssotest.Backend, path string) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.ServeHTTP(w, r)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := saveState(b, path); err != nil {
+			log.Printf("sso-mock: save state: %v", err)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 )
@@ -9,12 +10,16 @@ type SettingBoolean struct {
 }
 
 var (
-	ParamsError           = errors.New("Params Error")
-	AuthError             = errors.New("OAuth Fail")
-	IsDebug          bool = false
-	HTTP200OK             = "200 OK"
-	HTTP201CREATED        = "201 CREATED"
-	HTTP204NOCONTENT      = "204 NO CONTENT"
+	ParamsError      = errors.New("Params Error")
+	AuthError        = errors.New("OAuth Fail")
+	IsDebug     bool = false
+)
+
+//Deprecated: net/http reports "201 Created", compare StatusCode against the net/http constants instead
+var (
+	HTTP200OK        = "200 OK"
+	HTTP201CREATED   = "201 CREATED"
+	HTTP204NOCONTENT = "204 NO CONTENT"
 )
 
 const (
@@ -45,6 +50,20 @@ const (
 	REQUEST_PARAM_FORMAT_ERROR = iota + 20
 )
 
+//Transport is what user.User and oauth.OAuth need from api.API.
+//It lives here so that api can import both packages without a cycle.
+type Transport interface {
+	//Default context for calls made without one
+	Context() context.Context
+	GetFormatURL(QueryString string) string
+	GetURLContext(ctx context.Context, URL string) ([]byte, int, error)
+	GetURLWithParamsContext(ctx context.Context, URL string, params map[string]string) ([]byte, int, error)
+	PostURLContext(ctx context.Context, URL string, Value interface{}) ([]byte, int, error)
+	PatchURLContext(ctx context.Context, URL string, Value interface{}) ([]byte, int, error)
+	DeleteURLContext(ctx context.Context, URL string) ([]byte, int, error)
+}
+
+//Deprecated: use APIError
 type JSONError struct {
 	SpecialError     string
 	ErrorDescription string
@@ -69,146 +88,25 @@ type SENT_METHOD struct {
 }
 
 //cStruct MUST BE A Pointer!!!!
+//
+//Deprecated: use DecodeResult, which returns an *APIError.
 func ProcessResult(JSON []byte, cStruct interface{}) *JSONError {
-	var ret GeneralResult
-	if err := json.Unmarshal(JSON, &ret); err != nil {
-		return &JSONError{
-			ErrorDescription: err.Error(),
-		}
-	}
-
-	if ret.ErrCode != NO_ERROR {
-		switch ret.ErrCode {
-		case INNER_ARGUMENT_ERROR, REQUEST_PARAM_FORMAT_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.ErrorParam,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.ErrorParam,
-			}
-		case ITEM_NOT_FOUND_ERROR, ITEM_ALREADY_EXIST_ERROR, ITEM_EXPIRED_OR_USED_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.Item,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.Item,
-			}
-		case CREDENTIAL_NOT_MATCH:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.Credential,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.Credential,
-			}
-		case PERMISSION_DENIED, SENDER_SERVICE_ERROR, STORAGE_ENGINE_ERROR, UNKNOWN_INNER_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-			}
-		default:
-			return &JSONError{
-				ErrorDescription: "Unknown Error",
-			}
-		}
-	}
-	if err := json.Unmarshal(ret.Data, cStruct); err != nil {
-		return &JSONError{
-			ErrorDescription: err.Error(),
-		}
-	}
-	return nil
+	return toJSONError(DecodeResult(JSON, cStruct))
 }
 
+//Deprecated: use DecodeError, which returns an *APIError.
 func FetchError(JSON []byte) *JSONError {
-	var ret GeneralResult
-	if err := json.Unmarshal(JSON, &ret); err != nil {
-		return &JSONError{
-			ErrorDescription: err.Error(),
-		}
-	}
+	return toJSONError(DecodeError(JSON))
+}
 
-	if ret.ErrCode != NO_ERROR {
-		switch ret.ErrCode {
-		case INNER_ARGUMENT_ERROR, REQUEST_PARAM_FORMAT_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.ErrorParam,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.ErrorParam,
-			}
-		case ITEM_NOT_FOUND_ERROR, ITEM_ALREADY_EXIST_ERROR, ITEM_EXPIRED_OR_USED_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.Item,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.Item,
-			}
-		case CREDENTIAL_NOT_MATCH:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					SpecialError:     ret.Credential,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-				SpecialError:     ret.Credential,
-			}
-		case PERMISSION_DENIED, SENDER_SERVICE_ERROR, STORAGE_ENGINE_ERROR, UNKNOWN_INNER_ERROR:
-			if IsDebug {
-				return &JSONError{
-					ErrorDescription: ret.ErrorDescription,
-					ErrorFile:        ret.ErrorFile,
-					ErrorLine:        ret.ErrorLine,
-				}
-			}
-			return &JSONError{
-				ErrorDescription: ret.ErrorDescription,
-			}
-		default:
-			return &JSONError{
-				ErrorDescription: "Unknown Error",
-			}
-		}
+func toJSONError(err error) *JSONError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*APIError); ok {
+		return e.JSONError()
+	}
+	return &JSONError{
+		ErrorDescription: err.Error(),
 	}
-
-	return nil
 }
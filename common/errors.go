@@ -0,0 +1,179 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//APIError is the typed form of the GeneralResult error envelope.
+//Use errors.As to get at the details, or errors.Is with one of the Err* values below.
+type APIError struct {
+	Code        int
+	Description string
+	Param       string
+	Item        string
+	Credential  string
+	File        string
+	Line        int
+	HTTPStatus  int
+}
+
+//Sentinels to be used with errors.Is, they only compare errorCode
+var (
+	ErrUnknownInnerError  = &APIError{Code: UNKNOWN_INNER_ERROR}
+	ErrStorageEngine      = &APIError{Code: STORAGE_ENGINE_ERROR}
+	ErrInnerArgument      = &APIError{Code: INNER_ARGUMENT_ERROR}
+	ErrSenderService      = &APIError{Code: SENDER_SERVICE_ERROR}
+	ErrItemNotFound       = &APIError{Code: ITEM_NOT_FOUND_ERROR}
+	ErrItemAlreadyExist   = &APIError{Code: ITEM_ALREADY_EXIST_ERROR}
+	ErrItemExpiredOrUsed  = &APIError{Code: ITEM_EXPIRED_OR_USED_ERROR}
+	ErrPermissionDenied   = &APIError{Code: PERMISSION_DENIED}
+	ErrCredentialNotMatch = &APIError{Code: CREDENTIAL_NOT_MATCH}
+	ErrRequestParamFormat = &APIError{Code: REQUEST_PARAM_FORMAT_ERROR}
+)
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("interactivesso: errorCode %d", e.Code)
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	if detail := e.Detail(); detail != "" {
+		msg += " (" + detail + ")"
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code
+}
+
+//Detail returns the param, item or credential the error is about, depending on errorCode
+func (e *APIError) Detail() string {
+	switch e.Code {
+	case INNER_ARGUMENT_ERROR, REQUEST_PARAM_FORMAT_ERROR:
+		return e.Param
+	case ITEM_NOT_FOUND_ERROR, ITEM_ALREADY_EXIST_ERROR, ITEM_EXPIRED_OR_USED_ERROR:
+		return e.Item
+	case CREDENTIAL_NOT_MATCH:
+		return e.Credential
+	}
+	return ""
+}
+
+//JSONError converts e to the legacy error struct
+func (e *APIError) JSONError() *JSONError {
+	if !isKnownErrCode(e.Code) {
+		return &JSONError{
+			ErrorDescription: "Unknown Error",
+		}
+	}
+	return &JSONError{
+		ErrorDescription: e.Description,
+		SpecialError:     e.Detail(),
+		ErrorFile:        e.File,
+		ErrorLine:        e.Line,
+	}
+}
+
+func isKnownErrCode(code int) bool {
+	switch code {
+	case INNER_ARGUMENT_ERROR, REQUEST_PARAM_FORMAT_ERROR,
+		ITEM_NOT_FOUND_ERROR, ITEM_ALREADY_EXIST_ERROR, ITEM_EXPIRED_OR_USED_ERROR,
+		CREDENTIAL_NOT_MATCH,
+		PERMISSION_DENIED, SENDER_SERVICE_ERROR, STORAGE_ENGINE_ERROR, UNKNOWN_INNER_ERROR:
+		return true
+	}
+	return false
+}
+
+func newAPIError(ret *GeneralResult) *APIError {
+	e := &APIError{
+		Code:        ret.ErrCode,
+		Description: ret.ErrorDescription,
+		Param:       ret.ErrorParam,
+		Item:        ret.Item,
+		Credential:  ret.Credential,
+	}
+	if IsDebug {
+		e.File = ret.ErrorFile
+		e.Line = ret.ErrorLine
+	}
+	if e.Description == "" && !isKnownErrCode(e.Code) {
+		e.Description = "Unknown Error"
+	}
+	return e
+}
+
+//DecodeResult unmarshals the data field of a GeneralResult into cStruct.
+//If the envelope carries an errorCode, an *APIError is returned instead.
+//cStruct MUST BE A Pointer!!!!
+func DecodeResult(JSON []byte, cStruct interface{}) error {
+	var ret GeneralResult
+	if err := json.Unmarshal(JSON, &ret); err != nil {
+		return err
+	}
+
+	if ret.ErrCode != NO_ERROR {
+		return newAPIError(&ret)
+	}
+	return json.Unmarshal(ret.Data, cStruct)
+}
+
+//DecodeError is DecodeResult for responses without a data field.
+//An empty body (e.g. 204 No Content) is not an error.
+func DecodeError(JSON []byte) error {
+	if len(JSON) == 0 {
+		return nil
+	}
+	var ret GeneralResult
+	if err := json.Unmarshal(JSON, &ret); err != nil {
+		return err
+	}
+
+	if ret.ErrCode != NO_ERROR {
+		return newAPIError(&ret)
+	}
+	return nil
+}
+
+//SplitError turns err back into the legacy (*JSONError, error) pair.
+//An *APIError goes to the first value, anything else to the second one.
+func SplitError(err error) (*JSONError, error) {
+	if err == nil {
+		return nil, nil
+	}
+	if e, ok := err.(*APIError); ok {
+		return e.JSONError(), nil
+	}
+	return nil, err
+}
+
+//HTTPError is returned for a non-success HTTP status whose body isn't a GeneralResult error envelope
+type HTTPError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("interactivesso: unexpected HTTP status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+//StatusError builds the error for a response with an unexpected HTTP status.
+//The GeneralResult envelope is preferred, HTTPError is the fallback.
+func StatusError(StatusCode int, body []byte) error {
+	var ret GeneralResult
+	if err := json.Unmarshal(body, &ret); err == nil && ret.ErrCode != NO_ERROR {
+		e := newAPIError(&ret)
+		e.HTTPStatus = StatusCode
+		return e
+	}
+	return &HTTPError{
+		StatusCode: StatusCode,
+		Body:       body,
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrTokenNotFound = errors.New("token not found in store")
+
+//TokenKey identifies a stored token: an OAuth token by ClientID and MaskID,
+//a login token of the user package by UID with an empty ClientID
+type TokenKey struct {
+	ClientID string
+	MaskID   string
+	UID      int
+}
+
+func OAuthTokenKey(ClientID, MaskID string) TokenKey {
+	return TokenKey{
+		ClientID: ClientID,
+		MaskID:   MaskID,
+	}
+}
+
+func UserTokenKey(UID int) TokenKey {
+	return TokenKey{
+		UID: UID,
+	}
+}
+
+func (k TokenKey) String() string {
+	if k.MaskID != "" {
+		return "oauth/" + k.ClientID + "/" + k.MaskID
+	}
+	return "user/" + k.ClientID + "/" + strconv.Itoa(k.UID)
+}
+
+//TokenStore persists tokens, see package tokenstore for implementations.
+//Tokens are stored as JSON, Load works like json.Unmarshal.
+type TokenStore interface {
+	Save(key TokenKey, token interface{}) error
+	//token MUST BE A Pointer, ErrTokenNotFound if there is nothing under key
+	Load(key TokenKey, token interface{}) error
+	//Deleting a missing key is not an error
+	Delete(key TokenKey) error
+}
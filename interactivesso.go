@@ -8,7 +8,8 @@ import (
 	"github.com/InteractivePlus/InteractiveSSO-Go/api"
 )
 
-func NewAPI(ctx context.Context, customHttpClient *http.Client) *api.API {
+//Optional Params: middleware, applied in order around every request
+func NewAPI(ctx context.Context, customHttpClient *http.Client, middleware ...api.Middleware) *api.API {
 	_api := &api.API{}
 	if customHttpClient == nil {
 		_api.HttpClient = http.DefaultClient
@@ -23,6 +24,8 @@ func NewAPI(ctx context.Context, customHttpClient *http.Client) *api.API {
 	}
 
 	_api.Timeout = 30 * time.Second
+	_api.Retry = api.DefaultRetryPolicy()
+	_api.Middleware = middleware
 	_api.APIServer = api.APIServer
 	return _api
 }
@@ -0,0 +1,323 @@
+//Package notify sends notifications through the SSO to many users at once.
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+//Status is the outcome of a Job
+type Status int
+
+const (
+	StatusSent Status = iota
+	//The user allows no channel for the message, see oauth.ErrOptedOut
+	StatusOptedOut
+	StatusFailed
+	//The context ended before the job was done
+	StatusCanceled
+	//Held back by a Guard as a duplicate or over a rate limit, see SuppressedError
+	StatusSuppressed
+	//Not due yet, passed to a Dispatcher before its SendAt or within quiet hours, see ErrNotDue
+	StatusDeferred
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSent:
+		return "sent"
+	case StatusOptedOut:
+		return "opted_out"
+	case StatusFailed:
+		return "failed"
+	case StatusCanceled:
+		return "canceled"
+	case StatusSuppressed:
+		return "suppressed"
+	case StatusDeferred:
+		return "deferred"
+	}
+	return "unknown"
+}
+
+//ErrNotDue is the error of a StatusDeferred job
+var ErrNotDue = errors.New("notification not due yet, use an Outbox to hold it back")
+
+//Job is one message to the user behind Token or TokenKey
+type Job struct {
+	//Identifies the recipient in the Report, the MaskID of the token if empty
+	Recipient string `json:"recipient,omitempty"`
+	//Sent with as is, which suits jobs sent right away
+	Token *oauth.OAuthToken `json:"token,omitempty"`
+	//The token stored under TokenKey in the Store of the OAuth, fetched and refreshed
+	//at send time. Takes precedence over Token, scheduled jobs should use it.
+	TokenKey *common.TokenKey   `json:"token_key,omitempty"`
+	Message  oauth.Notification `json:"message"`
+	//Jobs with the same key are sent once within the DedupWindow of the Guard
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	//Not before SendAt, and never within quiet hours in the recipient's IANA TimeZone
+	//(UTC if empty), see Dispatcher.QuietHours. An Outbox holds the job back until then,
+	//a Dispatcher doesn't send it and reports StatusDeferred.
+	SendAt     time.Time   `json:"send_at,omitempty"`
+	TimeZone   string      `json:"time_zone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+func (j *Job) recipient() string {
+	switch {
+	case j.Recipient != "":
+		return j.Recipient
+	case j.TokenKey != nil:
+		return j.TokenKey.MaskID
+	case j.Token != nil:
+		return j.Token.MaskID
+	}
+	return ""
+}
+
+type Result struct {
+	Recipient string
+	Status    Status
+	//The channel the SSO used for StatusSent
+	Channel  oauth.Channel
+	Attempts int
+	Err      error
+}
+
+type Report struct {
+	Results    []Result
+	Sent       int
+	OptedOut   int
+	Failed     int
+	Canceled   int
+	Suppressed int
+	Deferred   int
+}
+
+func (r *Report) add(res Result) {
+	r.Results = append(r.Results, res)
+	switch res.Status {
+	case StatusSent:
+		r.Sent++
+	case StatusOptedOut:
+		r.OptedOut++
+	case StatusFailed:
+		r.Failed++
+	case StatusCanceled:
+		r.Canceled++
+	case StatusSuppressed:
+		r.Suppressed++
+	case StatusDeferred:
+		r.Deferred++
+	}
+}
+
+//Dispatcher sends Jobs with Concurrency workers, at most Rate sends a second over all of them
+type Dispatcher struct {
+	OAuth       *oauth.OAuth
+	Concurrency int
+	//Sends a second, 0 for no limit. Retries count as sends.
+	Rate float64
+	//Attempts per job, including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//Decides whether a failed send is tried again, IsRetryable if nil
+	Retryable func(err error) bool
+	//Optional, called from the workers as soon as a job is done
+	OnResult func(Result)
+	//Optional, suppresses duplicates and enforces rate limits
+	Guard *Guard
+	//For jobs without QuietHours of their own, nil for none
+	QuietHours *QuietHours
+	//Applies to sales messages in addition to the other window, DefaultSalesQuietHours by default
+	SalesQuietHours *QuietHours
+
+	tokens tokenSources
+}
+
+func NewDispatcher(o *oauth.OAuth) *Dispatcher {
+	return &Dispatcher{
+		OAuth:       o,
+		Concurrency: 8,
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		//A copy, so that changing it doesn't change the default
+		SalesQuietHours: &QuietHours{
+			Start: DefaultSalesQuietHours.Start,
+			End:   DefaultSalesQuietHours.End,
+		},
+	}
+}
+
+//IsRetryable is true only for failures that show the SSO didn't take the message:
+//a connection that couldn't be made, a failing sender service of the SSO and 429 or 503.
+//Timeouts and dropped connections may have been delivered and are not sent again,
+//a duplicate notification is worse than a missing one.
+func IsRetryable(err error) bool {
+	if errors.Is(err, common.ErrSenderService) {
+		return true
+	}
+	status := 0
+	var apiErr *common.APIError
+	var httpErr *common.HTTPError
+	if errors.As(err, &apiErr) {
+		status = apiErr.HTTPStatus
+	} else if errors.As(err, &httpErr) {
+		status = httpErr.StatusCode
+	}
+	if status != 0 {
+		return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	}
+	return api.IsDialError(err)
+}
+
+//Dispatch sends jobs and reports on every one of them
+func (d *Dispatcher) Dispatch(ctx context.Context, jobs []Job) *Report {
+	ch := make(chan Job)
+	go func() {
+		defer close(ch)
+		for _, j := range jobs {
+			select {
+			case ch <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	report := d.Run(ctx, ch)
+	//Jobs that never reached a worker
+	for _, j := range jobs[len(report.Results):] {
+		report.add(Result{
+			Recipient: j.recipient(),
+			Status:    StatusCanceled,
+			Err:       ctx.Err(),
+		})
+	}
+	return report
+}
+
+//Run sends the jobs of the channel until it is closed or ctx ends.
+//Results are in order of completion.
+func (d *Dispatcher) Run(ctx context.Context, jobs <-chan Job) *Report {
+	workers := d.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	limit := newLimiter(d.Rate)
+	var mu sync.Mutex
+	report := &Report{}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var j Job
+				var ok bool
+				select {
+				case j, ok = <-jobs:
+				case <-ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				res := d.send(ctx, limit, j)
+				if d.OnResult != nil {
+					d.OnResult(res)
+				}
+				mu.Lock()
+				report.add(res)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+//deliver makes one attempt at j past guard, StatusFailed may be worth another one
+func deliver(ctx context.Context, o *oauth.OAuth, tokens *tokenSources, guard *Guard, j Job) (oauth.Channel, Status, error) {
+	if j.Token == nil && j.TokenKey == nil {
+		return oauth.ChannelNone, StatusFailed, common.ParamsError
+	}
+	r, err := guard.admit(j)
+	if err != nil {
+		var suppressed *SuppressedError
+		if errors.As(err, &suppressed) {
+			return oauth.ChannelNone, StatusSuppressed, err
+		}
+		return oauth.ChannelNone, StatusFailed, err
+	}
+	c := oauth.ChannelNone
+	requested := false
+	token, err := tokens.token(ctx, o, &j)
+	if err == nil {
+		requested = true
+		c, err = o.SendNotificationWithToken(ctx, token, j.Message)
+	}
+	status := StatusFailed
+	switch {
+	case err == nil:
+		status = StatusSent
+	case errors.Is(err, oauth.ErrOptedOut):
+		status = StatusOptedOut
+	case ctx.Err() != nil:
+		status = StatusCanceled
+	}
+	maybeSent := requested && (status == StatusFailed || status == StatusCanceled) && !unsent(err)
+	guard.done(r, status, c, maybeSent)
+	return c, status, err
+}
+
+func (d *Dispatcher) send(ctx context.Context, limit *limiter, j Job) Result {
+	res := Result{
+		Recipient: j.recipient(),
+	}
+	if err := j.validateSchedule(); err != nil {
+		res.Status, res.Err = StatusFailed, err
+		return res
+	}
+	//Holding jobs back is up to the Outbox, that survives the wait
+	if now := time.Now(); holdUntil(&j, now, d.QuietHours, d.SalesQuietHours).After(now) {
+		res.Status, res.Err = StatusDeferred, ErrNotDue
+		return res
+	}
+	retryable := d.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	for {
+		if err := limit.wait(ctx); err != nil {
+			res.Status, res.Err = StatusCanceled, err
+			return res
+		}
+		res.Attempts++
+		res.Channel, res.Status, res.Err = deliver(ctx, d.OAuth, &d.tokens, d.Guard, j)
+		if res.Status != StatusFailed || res.Attempts >= d.MaxAttempts || !retryable(res.Err) {
+			return res
+		}
+		if err := sleep(ctx, backoff(d.BaseDelay, d.MaxDelay, res.Attempts)); err != nil {
+			res.Status = StatusCanceled
+			return res
+		}
+	}
+}
+
+//backoff is the delay after attempt failed
+func backoff(BaseDelay, MaxDelay time.Duration, attempt int) time.Duration {
+	delay := BaseDelay << uint(attempt-1)
+	if delay < BaseDelay || (MaxDelay > 0 && delay > MaxDelay) {
+		delay = MaxDelay
+	}
+	return delay
+}
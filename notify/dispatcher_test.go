@@ -0,0 +1,69 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/notify"
+)
+
+//timeout is a net.Error that timed out
+type timeout struct{}
+
+func (timeout) Error() string   { return "i/o timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, true},
+		{"sender service", &common.APIError{Code: common.SENDER_SERVICE_ERROR, HTTPStatus: 500}, true},
+		{"429", &common.APIError{Code: common.UNKNOWN_INNER_ERROR, HTTPStatus: 429}, true},
+		{"503", &common.HTTPError{StatusCode: 503}, true},
+		{"500", &common.HTTPError{StatusCode: 500}, false},
+		{"400", &common.APIError{Code: common.REQUEST_PARAM_FORMAT_ERROR, HTTPStatus: 400}, false},
+		{"connection reset", &url.Error{Op: "Post", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, false},
+		{"timeout", &url.Error{Op: "Post", Err: timeout{}}, false},
+		{"unexpected EOF", fmt.Errorf("reading response: %w", io.ErrUnexpectedEOF), false},
+		{"deadline", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if got := notify.IsRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: IsRetryable is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherDefersJobsNotDue(t *testing.T) {
+	srv, o, tokens := newSSO(t, 1)
+	d := notify.NewDispatcher(o)
+	d.SalesQuietHours = nil
+	report := d.Dispatch(context.Background(), []notify.Job{
+		{Token: tokens[0], Message: message("later"), SendAt: time.Now().Add(time.Hour)},
+		{Token: tokens[0], Message: message("quiet"), QuietHours: &notify.QuietHours{Start: "00:00", End: "23:59"}},
+		{Token: tokens[0], Message: message("now")},
+	})
+	if report.Deferred != 2 || report.Sent != 1 || report.Failed != 0 {
+		t.Fatalf("report %+v, want 2 deferred and 1 sent", report)
+	}
+	for _, res := range report.Results {
+		if res.Status == notify.StatusDeferred && (!errors.Is(res.Err, notify.ErrNotDue) || res.Attempts != 0) {
+			t.Errorf("result %+v, want ErrNotDue without an attempt", res)
+		}
+	}
+	if n := len(srv.Notifications()); n != 1 {
+		t.Fatalf("%d notifications were sent, want 1", n)
+	}
+}
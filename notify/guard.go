@@ -0,0 +1,361 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+var (
+	//ErrDuplicate is a job whose IdempotencyKey was sent within the dedup window
+	ErrDuplicate = errors.New("notification already sent")
+	//ErrRateLimited is a job whose recipient reached a RateLimit
+	ErrRateLimited = errors.New("notification rate limit reached")
+)
+
+//SuppressedError tells why Guard held a job back, it matches ErrDuplicate or ErrRateLimited
+type SuppressedError struct {
+	Reason error
+	//The limit that was hit, nil for duplicates
+	Limit *RateLimit
+}
+
+func (e *SuppressedError) Error() string {
+	if e.Limit != nil {
+		return fmt.Sprintf("%v: %s", e.Reason, e.Limit)
+	}
+	return e.Reason.Error()
+}
+
+func (e *SuppressedError) Unwrap() error {
+	return e.Reason
+}
+
+//RateLimit allows Max sends to a recipient within Per.
+//Channel ChannelNone counts sends through any channel.
+type RateLimit struct {
+	Channel oauth.Channel
+	Max     int
+	Per     time.Duration
+}
+
+func (l *RateLimit) String() string {
+	if l.Channel == oauth.ChannelNone {
+		return fmt.Sprintf("%d per %s", l.Max, l.Per)
+	}
+	return fmt.Sprintf("%d %s per %s", l.Max, l.Channel, l.Per)
+}
+
+//Guard suppresses duplicate and excess notifications before they reach the SSO.
+//Share one Guard between everything sending to the same users.
+//
+//A job takes its place within the limits when it is admitted, so concurrent jobs can't
+//overrun them, and gives it back unless it was or may have been sent. The SSO picks the channel itself,
+//so a job is held back if any channel the SSO might pick is over its limit: those the
+//Message.Settings allow, or every channel without Settings.
+//
+//Send times are kept in memory. IdempotencyKeys are too, unless the Guard was opened
+//with OpenGuard, which keeps them in a journal so that a restart doesn't send twice.
+type Guard struct {
+	//How long an IdempotencyKey is remembered after its job was sent
+	DedupWindow time.Duration
+	Limits      []RateLimit
+	Now         func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*dedupEntry
+	//Send times by recipient and channel, ChannelNone holds those of every channel
+	sends map[string]map[oauth.Channel][]time.Time
+	//Optional, where keys are kept
+	journal *journal
+}
+
+type dedupEntry struct {
+	//Zero while the job is on its way
+	sent time.Time
+	//When the job was admitted
+	admitted time.Time
+}
+
+//dedupRecord is one line of the key journal of a Guard.
+//A job is reserved before it is sent, and released again if it wasn't.
+type dedupRecord struct {
+	//"reserve" or "release"
+	Op  string    `json:"op"`
+	Key string    `json:"key"`
+	At  time.Time `json:"at,omitempty"`
+}
+
+func NewGuard(DedupWindow time.Duration, Limits ...RateLimit) *Guard {
+	return &Guard{
+		DedupWindow: DedupWindow,
+		Limits:      Limits,
+		Now:         time.Now,
+		keys:        map[string]*dedupEntry{},
+		sends:       map[string]map[oauth.Channel][]time.Time{},
+	}
+}
+
+//OpenGuard is NewGuard with the IdempotencyKeys kept in the journal at path, which is created if needed.
+//A job that was on its way when the process ended may have been sent, it counts as sent.
+//Sending it again after a restart is suppressed as a duplicate, which makes keyed jobs
+//of an Outbox at most once.
+func OpenGuard(path string, DedupWindow time.Duration, Limits ...RateLimit) (*Guard, error) {
+	g := NewGuard(DedupWindow, Limits...)
+	var err error
+	g.journal, err = openJournal(path, func(data []byte) error {
+		var r dedupRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		switch r.Op {
+		case "reserve":
+			g.keys[r.Key] = &dedupEntry{sent: r.At, admitted: r.At}
+		case "release":
+			delete(g.keys, r.Key)
+		default:
+			return fmt.Errorf("%s: unknown op %q", path, r.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+//OpenGuard opens a Guard with its keys next to the files of b, at their path + ".keys",
+//and makes it the Guard of b. Close closes it along with b.
+func (b *Outbox) OpenGuard(DedupWindow time.Duration, Limits ...RateLimit) (*Guard, error) {
+	g, err := OpenGuard(b.pending.path+".keys", DedupWindow, Limits...)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ownGuard != nil {
+		b.ownGuard.Close()
+	}
+	b.Guard, b.ownGuard = g, g
+	return g, nil
+}
+
+//Close closes the journal of a Guard from OpenGuard, it must not be used afterwards
+func (g *Guard) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.journal == nil {
+		return nil
+	}
+	return g.journal.close()
+}
+
+//reservation is the place an admitted job holds within the limits until done
+type reservation struct {
+	key       string
+	recipient string
+	at        time.Time
+	channels  oauth.Channels
+}
+
+//possibleChannels are those the SSO might send j through
+func possibleChannels(j *Job) oauth.Channels {
+	if j.Message.Settings != nil {
+		return oauth.AllowedChannels(*j.Message.Settings, j.Message.IsSales, nil)
+	}
+	return oauth.DefaultChannelOrder
+}
+
+//admit reserves the place of j within the limits, to be given back to done.
+//A job held back gives a *SuppressedError, one that couldn't be recorded another error.
+func (g *Guard) admit(j Job) (*reservation, error) {
+	if g == nil {
+		return nil, nil
+	}
+	now := g.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	if j.IdempotencyKey != "" {
+		if _, ok := g.keys[j.IdempotencyKey]; ok {
+			return nil, &SuppressedError{Reason: ErrDuplicate}
+		}
+	}
+	r := &reservation{
+		key:       j.IdempotencyKey,
+		recipient: j.recipient(),
+		at:        now,
+	}
+	if r.recipient != "" {
+		possible := possibleChannels(&j)
+		for i := range g.Limits {
+			l := &g.Limits[i]
+			if l.Channel != oauth.ChannelNone && !possible.Has(l.Channel) {
+				continue
+			}
+			if g.count(r.recipient, l.Channel, now.Add(-l.Per)) >= l.Max {
+				return nil, &SuppressedError{Reason: ErrRateLimited, Limit: l}
+			}
+		}
+		r.channels = oauth.Channels{oauth.ChannelNone}.Add(possible...)
+	}
+	if r.key != "" {
+		if g.journal != nil {
+			if err := g.write(&dedupRecord{Op: "reserve", Key: r.key, At: now}); err != nil {
+				return nil, err
+			}
+		}
+		g.keys[r.key] = &dedupEntry{admitted: now}
+	}
+	if r.recipient != "" {
+		byChannel := g.sends[r.recipient]
+		if byChannel == nil {
+			byChannel = map[oauth.Channel][]time.Time{}
+			g.sends[r.recipient] = byChannel
+		}
+		for _, c := range r.channels {
+			byChannel[c] = append(byChannel[c], now)
+		}
+	}
+	return r, nil
+}
+
+//done settles the reservation of an admitted job. It is kept for the channel used if the job
+//was sent. A job that may have been sent, see unsent, keeps its IdempotencyKey and its place
+//among sends through any channel. Everything else is given back.
+func (g *Guard) done(r *reservation, status Status, c oauth.Channel, maybeSent bool) {
+	if g == nil || r == nil {
+		return
+	}
+	now := g.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	final := status == StatusSent || status == StatusOptedOut
+	if r.key != "" {
+		//A copy of a job that was or may have been sent is a duplicate
+		if final || maybeSent {
+			g.keys[r.key] = &dedupEntry{sent: now, admitted: r.at}
+		} else {
+			delete(g.keys, r.key)
+			//Should this fail the key stays reserved in the journal, which errs on the side of not sending twice
+			if g.journal != nil {
+				g.write(&dedupRecord{Op: "release", Key: r.key})
+			}
+		}
+	}
+	if r.recipient == "" {
+		return
+	}
+	byChannel := g.sends[r.recipient]
+	if byChannel == nil {
+		byChannel = map[oauth.Channel][]time.Time{}
+		g.sends[r.recipient] = byChannel
+	}
+	for _, v := range r.channels {
+		if v == oauth.ChannelNone && (status == StatusSent || maybeSent) {
+			continue
+		}
+		if status == StatusSent && v == c {
+			continue
+		}
+		byChannel[v] = removeTime(byChannel[v], r.at)
+	}
+	if status == StatusSent && c != oauth.ChannelNone && !r.channels.Has(c) {
+		//The SSO used a channel that wasn't expected
+		byChannel[c] = append(byChannel[c], r.at)
+	}
+}
+
+//unsent tells whether a failed request provably didn't get anything sent: it was refused
+//before it left, the SSO rejected it, or it never reached the SSO. A timeout or a dropped
+//connection may have been sent nonetheless.
+func unsent(err error) bool {
+	if errors.Is(err, common.ParamsError) || errors.Is(err, oauth.ErrInsufficientScope) || IsRetryable(err) {
+		return true
+	}
+	var apiErr *common.APIError
+	var httpErr *common.HTTPError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.HTTPStatus >= 400 && apiErr.HTTPStatus < 500
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode >= 400 && httpErr.StatusCode < 500
+	}
+	return false
+}
+
+//removeTime removes one occurrence of t from times
+func removeTime(times []time.Time, t time.Time) []time.Time {
+	for i := range times {
+		if times[i].Equal(t) {
+			return append(times[:i:i], times[i+1:]...)
+		}
+	}
+	return times
+}
+
+//write appends r to the journal, after compacting it if due. It expects g.mu to be held.
+func (g *Guard) write(r *dedupRecord) error {
+	if g.journal.needsCompaction(len(g.keys)) {
+		live := make([]interface{}, 0, len(g.keys))
+		for k, e := range g.keys {
+			at := e.sent
+			if at.IsZero() {
+				at = e.admitted
+			}
+			live = append(live, &dedupRecord{Op: "reserve", Key: k, At: at})
+		}
+		if err := g.journal.compact(live); err != nil {
+			return err
+		}
+	}
+	return g.journal.append(r)
+}
+
+//count expects g.mu to be held
+func (g *Guard) count(recipient string, c oauth.Channel, since time.Time) int {
+	n := 0
+	for _, t := range g.sends[recipient][c] {
+		if t.After(since) {
+			n++
+		}
+	}
+	return n
+}
+
+//prune forgets what no window looks at anymore, it expects g.mu to be held
+func (g *Guard) prune(now time.Time) {
+	for k, e := range g.keys {
+		if !e.sent.IsZero() && now.Sub(e.sent) >= g.DedupWindow {
+			delete(g.keys, k)
+		}
+	}
+	var longest time.Duration
+	for _, l := range g.Limits {
+		if l.Per > longest {
+			longest = l.Per
+		}
+	}
+	for recipient, byChannel := range g.sends {
+		for c, times := range byChannel {
+			i := 0
+			for i < len(times) && now.Sub(times[i]) >= longest {
+				i++
+			}
+			if i == len(times) {
+				delete(byChannel, c)
+			} else {
+				byChannel[c] = times[i:]
+			}
+		}
+		if len(byChannel) == 0 {
+			delete(g.sends, recipient)
+		}
+	}
+}
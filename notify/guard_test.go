@@ -0,0 +1,134 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/notify"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+//dispatchOne sends j with a Dispatcher of o behind g
+func dispatchOne(o *oauth.OAuth, g *notify.Guard, j notify.Job) notify.Result {
+	d := notify.NewDispatcher(o)
+	d.Guard = g
+	d.BaseDelay = time.Millisecond
+	return d.Dispatch(context.Background(), []notify.Job{j}).Results[0]
+}
+
+func TestGuardDedup(t *testing.T) {
+	srv, o, tokens := newSSO(t, 1)
+	g := notify.NewGuard(time.Hour)
+	keyed := func(key string) notify.Job {
+		return notify.Job{Token: tokens[0], Message: message(key), IdempotencyKey: key}
+	}
+
+	if res := dispatchOne(o, g, keyed("a")); res.Status != notify.StatusSent {
+		t.Fatalf("first send: %+v", res)
+	}
+	if res := dispatchOne(o, g, keyed("a")); res.Status != notify.StatusSuppressed || !errors.Is(res.Err, notify.ErrDuplicate) {
+		t.Fatalf("second send: %+v, want suppressed as duplicate", res)
+	}
+
+	//The SSO refused it, nothing was sent and a copy may go
+	srv.InjectError("POST", notificationsPath, 400, common.REQUEST_PARAM_FORMAT_ERROR)
+	if res := dispatchOne(o, g, keyed("b")); res.Status != notify.StatusFailed {
+		t.Fatalf("refused send: %+v", res)
+	}
+	if res := dispatchOne(o, g, keyed("b")); res.Status != notify.StatusSent {
+		t.Fatalf("send after a refusal: %+v, want sent", res)
+	}
+
+	//The SSO failed on its way, the message may have gone out
+	srv.InjectError("POST", notificationsPath, 500, common.UNKNOWN_INNER_ERROR)
+	if res := dispatchOne(o, g, keyed("c")); res.Status != notify.StatusFailed {
+		t.Fatalf("failed send: %+v", res)
+	}
+	if res := dispatchOne(o, g, keyed("c")); res.Status != notify.StatusSuppressed {
+		t.Fatalf("send after an ambiguous failure: %+v, want suppressed", res)
+	}
+
+	if n := len(srv.Notifications()); n != 2 {
+		t.Fatalf("%d notifications were sent, want 2", n)
+	}
+	//Keys are forgotten after the window
+	later := time.Now().Add(2 * time.Hour)
+	g.Now = func() time.Time { return later }
+	if res := dispatchOne(o, g, keyed("a")); res.Status != notify.StatusSent {
+		t.Fatalf("send after the dedup window: %+v, want sent", res)
+	}
+}
+
+func TestGuardJournal(t *testing.T) {
+	srv, o, tokens := newSSO(t, 1)
+	path := filepath.Join(t.TempDir(), "keys")
+	g, err := notify.OpenGuard(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenGuard: %v", err)
+	}
+	keyed := func(key string) notify.Job {
+		return notify.Job{Token: tokens[0], Message: message(key), IdempotencyKey: key}
+	}
+	if res := dispatchOne(o, g, keyed("sent")); res.Status != notify.StatusSent {
+		t.Fatalf("send: %+v", res)
+	}
+	srv.InjectError("POST", notificationsPath, 400, common.REQUEST_PARAM_FORMAT_ERROR)
+	if res := dispatchOne(o, g, keyed("refused")); res.Status != notify.StatusFailed {
+		t.Fatalf("refused send: %+v", res)
+	}
+	g.Close()
+
+	if g, err = notify.OpenGuard(path, time.Hour); err != nil {
+		t.Fatalf("OpenGuard after restart: %v", err)
+	}
+	defer g.Close()
+	if res := dispatchOne(o, g, keyed("sent")); res.Status != notify.StatusSuppressed {
+		t.Fatalf("send after restart: %+v, want suppressed", res)
+	}
+	if res := dispatchOne(o, g, keyed("refused")); res.Status != notify.StatusSent {
+		t.Fatalf("released key after restart: %+v, want sent", res)
+	}
+}
+
+func TestGuardRateLimit(t *testing.T) {
+	srv, o, tokens := newSSO(t, 2)
+	g := notify.NewGuard(0, notify.RateLimit{Channel: oauth.ChannelNone, Max: 2, Per: time.Hour})
+	to := func(i int) notify.Job {
+		return notify.Job{Token: tokens[i], Message: message("hi")}
+	}
+
+	//A refused send takes no place
+	srv.InjectError("POST", notificationsPath, 400, common.REQUEST_PARAM_FORMAT_ERROR)
+	if res := dispatchOne(o, g, to(0)); res.Status != notify.StatusFailed {
+		t.Fatalf("refused send: %+v", res)
+	}
+	for i := 0; i < 2; i++ {
+		if res := dispatchOne(o, g, to(0)); res.Status != notify.StatusSent {
+			t.Fatalf("send %d: %+v", i, res)
+		}
+	}
+	res := dispatchOne(o, g, to(0))
+	var suppressed *notify.SuppressedError
+	if !errors.As(res.Err, &suppressed) || !errors.Is(res.Err, notify.ErrRateLimited) || suppressed.Limit.Max != 2 {
+		t.Fatalf("third send: %+v, want rate limited", res)
+	}
+	//The limit is per recipient
+	if res := dispatchOne(o, g, to(1)); res.Status != notify.StatusSent {
+		t.Fatalf("send to another recipient: %+v", res)
+	}
+
+	//Concurrent jobs can't overrun the limit
+	d := notify.NewDispatcher(o)
+	d.Guard = notify.NewGuard(0, notify.RateLimit{Channel: oauth.ChannelEmail, Max: 1, Per: time.Hour})
+	jobs := make([]notify.Job, 8)
+	for i := range jobs {
+		jobs[i] = to(1)
+	}
+	if report := d.Dispatch(context.Background(), jobs); report.Sent != 1 || report.Suppressed != 7 {
+		t.Fatalf("report %+v, want 1 sent and 7 suppressed", report)
+	}
+}
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/internal/fileutil"
+)
+
+//A journal is compacted once it holds this many records and more than twice as many as are live
+const compactAfter = 1000
+
+//journal is an append-only file of JSON records, one per line.
+//Every append is synced before it returns, so a record that was acknowledged survives a crash.
+type journal struct {
+	path string
+	f    *os.File
+	//Records in the file, live or not
+	records int
+}
+
+//openJournal replays the records at path, creating the file if needed.
+//A last line without newline is a write torn by a crash and is cut off.
+func openJournal(path string, replay func(data []byte) error) (*journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	created := os.IsNotExist(err)
+	j := &journal{
+		path: path,
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:end], []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := replay(line); err != nil {
+			return nil, err
+		}
+		j.records++
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if end < len(data) {
+		if err := f.Truncate(int64(end)); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if created {
+		if err := fileutil.SyncDir(filepath.Dir(path)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	j.f = f
+	return j, nil
+}
+
+func marshalRecords(records []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+//append writes records with a single write and syncs them
+func (j *journal) append(records ...interface{}) error {
+	data, err := marshalRecords(records)
+	if err != nil {
+		return err
+	}
+	if j.f == nil {
+		//A compaction couldn't reopen the file
+		if j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			j.f = nil
+			return err
+		}
+	}
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(data); err != nil {
+		//Later records must not be glued to a partial one
+		j.f.Truncate(info.Size())
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.records += len(records)
+	return nil
+}
+
+//needsCompaction tells whether the file has grown well beyond the live records
+func (j *journal) needsCompaction(live int) bool {
+	return j.records >= compactAfter && j.records > 2*live
+}
+
+//compact replaces the file with the live records
+func (j *journal) compact(live []interface{}) error {
+	data, err := marshalRecords(live)
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteFileAtomic(j.path, data, 0600); err != nil {
+		return err
+	}
+	//The old file is gone, appending to it would lose the records
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	j.records = len(live)
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		j.f = nil
+	}
+	return err
+}
+
+func (j *journal) close() error {
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
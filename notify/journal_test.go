@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	N int `json:"n"`
+}
+
+//replayed opens the journal at path and returns it with the records it replayed
+func replayed(t *testing.T, path string) (*journal, []int) {
+	t.Helper()
+	var got []int
+	j, err := openJournal(path, func(data []byte) error {
+		var r testRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		got = append(got, r.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	t.Cleanup(func() { j.close() })
+	return j, got
+}
+
+func TestJournalCutsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	//A crash in the middle of the third append
+	if err := ioutil.WriteFile(path, []byte("{\"n\":1}\n{\"n\":2}\n{\"n\":"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	j, got := replayed(t, path)
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("replayed %v, want [1 2]", got)
+	}
+	if err := j.append(&testRecord{N: 3}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	j.close()
+
+	//The torn line must not corrupt the record appended after it
+	if _, got = replayed(t, path); len(got) != 3 || got[2] != 3 {
+		t.Fatalf("replayed %v after the append, want [1 2 3]", got)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, _ := replayed(t, path)
+	records := make([]interface{}, compactAfter)
+	for i := range records {
+		records[i] = &testRecord{N: i}
+	}
+	if err := j.append(records...); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if j.needsCompaction(compactAfter) {
+		t.Fatal("a journal of live records needs compaction")
+	}
+	if !j.needsCompaction(1) {
+		t.Fatal("a journal of one live record out of many doesn't need compaction")
+	}
+	if err := j.compact([]interface{}{&testRecord{N: 7}}); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	//Appends go to the compacted file, not to the one it replaced
+	if err := j.append(&testRecord{N: 8}); err != nil {
+		t.Fatalf("append after compact: %v", err)
+	}
+	j.close()
+
+	if _, got := replayed(t, path); len(got) != 2 || got[0] != 7 || got[1] != 8 {
+		t.Fatalf("replayed %v, want [7 8]", got)
+	}
+}
@@ -0,0 +1,536 @@
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+var (
+	ErrEntryNotFound = errors.New("outbox entry not found")
+	//ErrTokenExpiresFirst is a job with a Token that expires before the job is due, while the OAuth has no Store to keep it in
+	ErrTokenExpiresFirst = errors.New("token expires before the notification is due")
+)
+
+//OutboxEntry is a Job waiting in the Outbox or its dead-letter file
+type OutboxEntry struct {
+	ID      string    `json:"id"`
+	Job     Job       `json:"job"`
+	Created time.Time `json:"created"`
+	//Attempts made so far, NextAttempt is when the next one is due
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+//Outbox queues Jobs in a file and delivers them in the background with Run.
+//Jobs that fail MaxAttempts times, or fail in a way not worth retrying, move to the dead-letter file.
+//
+//Both files are journals: every change is appended and synced, and the file is rewritten
+//with the live entries once it has grown well beyond them.
+//Delivery is at least once: a job sent right before a crash is sent again after the restart.
+//Jobs with an IdempotencyKey are the exception once the Guard comes from OpenGuard: those
+//are sent at most once, a job that was on its way during a crash leaves the queue with
+//StatusSuppressed after the restart, whether it reached the SSO or not.
+//Jobs are queued with a TokenKey, see Enqueue. The files are written with mode 0600
+//as they may hold access tokens nonetheless. One process per file.
+type Outbox struct {
+	OAuth *oauth.OAuth
+	//Sends a second, 0 for no limit
+	Rate        float64
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//Decides whether a failed send is tried again, IsRetryable if nil
+	Retryable func(err error) bool
+	//Optional, called for every job that leaves the queue, including those moved to the dead-letter file
+	OnResult func(OutboxEntry, Result)
+	Now      func() time.Time
+	//For jobs without QuietHours of their own, nil for none
+	QuietHours *QuietHours
+	//Applies to sales messages in addition to the other window, DefaultSalesQuietHours by default
+	SalesQuietHours *QuietHours
+	//Optional, suppresses duplicates and enforces rate limits.
+	//Suppressed jobs leave the queue with StatusSuppressed. See OpenGuard.
+	Guard *Guard
+
+	mu      sync.Mutex
+	pending *entryLog
+	dead    *entryLog
+	wake    chan struct{}
+	tokens  tokenSources
+	//The Guard opened by OpenGuard, closed along with b
+	ownGuard *Guard
+}
+
+//NewOutbox opens the queue at path and the dead-letter file at path + ".dead", creating them if needed
+func NewOutbox(o *oauth.OAuth, path string) (*Outbox, error) {
+	b := &Outbox{
+		OAuth:       o,
+		MaxAttempts: 8,
+		BaseDelay:   time.Second,
+		MaxDelay:    10 * time.Minute,
+		Now:         time.Now,
+		//A copy, so that changing it doesn't change the default
+		SalesQuietHours: &QuietHours{
+			Start: DefaultSalesQuietHours.Start,
+			End:   DefaultSalesQuietHours.End,
+		},
+		wake: make(chan struct{}, 1),
+	}
+	//b.Now may be replaced later on
+	b.tokens.now = func() time.Time {
+		return b.Now()
+	}
+	var err error
+	if b.pending, err = openEntryLog(path); err != nil {
+		return nil, err
+	}
+	if b.dead, err = openEntryLog(path + ".dead"); err != nil {
+		b.pending.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+//Close closes the files of b, it must not be used afterwards
+func (b *Outbox) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.pending.close()
+	if err2 := b.dead.close(); err == nil {
+		err = err2
+	}
+	if b.ownGuard != nil {
+		if err2 := b.ownGuard.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+//entryRecord is one line of an entryLog
+type entryRecord struct {
+	//"put" stores Entry, "del" removes the entry with ID
+	Op    string       `json:"op"`
+	ID    string       `json:"id"`
+	Entry *OutboxEntry `json:"entry,omitempty"`
+}
+
+//entryLog is a set of entries kept in a journal.
+//Changes go to the file first, the entries only change once the file has them.
+type entryLog struct {
+	*journal
+	entries map[string]*OutboxEntry
+}
+
+func openEntryLog(path string) (*entryLog, error) {
+	l := &entryLog{
+		entries: map[string]*OutboxEntry{},
+	}
+	var err error
+	l.journal, err = openJournal(path, func(data []byte) error {
+		var r entryRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		switch r.Op {
+		case "put":
+			if r.Entry == nil {
+				return fmt.Errorf("%s: put of %s without entry", path, r.ID)
+			}
+			l.entries[r.ID] = r.Entry
+		case "del":
+			delete(l.entries, r.ID)
+		default:
+			return fmt.Errorf("%s: unknown op %q", path, r.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//write appends records, after compacting the journal if it is due
+func (l *entryLog) write(records []interface{}) error {
+	if l.needsCompaction(len(l.entries)) {
+		live := make([]interface{}, 0, len(l.entries))
+		for _, e := range listEntries(l.entries) {
+			e := e
+			live = append(live, &entryRecord{Op: "put", ID: e.ID, Entry: &e})
+		}
+		if err := l.compact(live); err != nil {
+			return err
+		}
+	}
+	return l.append(records...)
+}
+
+//put stores copies of entries
+func (l *entryLog) put(entries ...*OutboxEntry) error {
+	records := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		e := *e
+		records = append(records, &entryRecord{Op: "put", ID: e.ID, Entry: &e})
+	}
+	if err := l.write(records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		r := r.(*entryRecord)
+		l.entries[r.ID] = r.Entry
+	}
+	return nil
+}
+
+func (l *entryLog) del(IDs ...string) error {
+	records := make([]interface{}, 0, len(IDs))
+	for _, id := range IDs {
+		records = append(records, &entryRecord{Op: "del", ID: id})
+	}
+	if err := l.write(records); err != nil {
+		return err
+	}
+	for _, id := range IDs {
+		delete(l.entries, id)
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (b *Outbox) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Enqueue stores j and returns its ID once it is safely on disk.
+//It is sent at j.SendAt or right away, outside of quiet hours in either case.
+//
+//A job with a Token is queued with a TokenKey instead, so that the token is refreshed
+//when the job is sent. The token is saved to the Store of b.OAuth unless the Store
+//holds a newer one. Without a Store a job due after its token expires is refused
+//with ErrTokenExpiresFirst.
+func (b *Outbox) Enqueue(j Job) (string, error) {
+	if err := j.validateSchedule(); err != nil {
+		return "", err
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	now := b.Now()
+	hold := holdUntil(&j, now, b.QuietHours, b.SalesQuietHours)
+	if j, err = b.keyed(j, hold); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err = b.pending.put(&OutboxEntry{
+		ID:          id,
+		Job:         j,
+		Created:     now,
+		NextAttempt: hold,
+	})
+	if err != nil {
+		return "", err
+	}
+	b.notify()
+	return id, nil
+}
+
+//keyed moves the Token of j to the Store of b.OAuth and returns j with its TokenKey
+func (b *Outbox) keyed(j Job, hold time.Time) (Job, error) {
+	if j.TokenKey != nil || j.Token == nil {
+		return j, nil
+	}
+	store := b.OAuth.Config().Store
+	if store == nil {
+		if exp := j.Token.ExpiresAt(); !exp.IsZero() && !hold.Before(exp) {
+			return j, ErrTokenExpiresFirst
+		}
+		return j, nil
+	}
+	if j.Token.MaskID == "" || j.Token.ClientID != b.OAuth.ClientID() {
+		return j, common.ParamsError
+	}
+	key := common.OAuthTokenKey(j.Token.ClientID, j.Token.MaskID)
+	//A stored token that was refreshed since j was made must not be overwritten,
+	//its refresh token is the one that still works
+	stored, err := b.OAuth.StoredToken(j.Token.MaskID)
+	if errors.Is(err, common.ErrTokenNotFound) || (err == nil && renewed(stored) < renewed(j.Token)) {
+		err = store.Save(key, j.Token)
+	}
+	if err != nil {
+		return j, err
+	}
+	j.Token = nil
+	j.TokenKey = &key
+	return j, nil
+}
+
+//renewed is when t was issued or last refreshed
+func renewed(t *oauth.OAuthToken) int {
+	if t.LastRenewed > t.Issued {
+		return t.LastRenewed
+	}
+	return t.Issued
+}
+
+//Schedule enqueues j to be sent at SendAt
+func (b *Outbox) Schedule(j Job, SendAt time.Time) (string, error) {
+	j.SendAt = SendAt
+	return b.Enqueue(j)
+}
+
+//Run delivers due jobs until ctx ends
+func (b *Outbox) Run(ctx context.Context) error {
+	limit := newLimiter(b.Rate)
+	for {
+		next, err := b.deliverDue(ctx, limit)
+		if err != nil {
+			return err
+		}
+		var t *time.Timer
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			t = time.NewTimer(next.Sub(b.Now()))
+			timer = t.C
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-b.wake:
+		case <-timer:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//deliverDue makes one attempt at every due job and returns when the next one is due, zero if none is
+func (b *Outbox) deliverDue(ctx context.Context, limit *limiter) (time.Time, error) {
+	for _, e := range b.due() {
+		//A retry may have become due within quiet hours
+		now := b.Now()
+		if hold := holdUntil(&e.Job, now, b.QuietHours, b.SalesQuietHours); hold.After(now) {
+			if err := b.postpone(e.ID, hold); err != nil {
+				return time.Time{}, err
+			}
+			continue
+		}
+		if err := limit.wait(ctx); err != nil {
+			return time.Time{}, err
+		}
+		c, status, err := deliver(ctx, b.OAuth, &b.tokens, b.Guard, e.Job)
+		if status == StatusCanceled {
+			return time.Time{}, ctx.Err()
+		}
+		if err := b.record(e, c, status, err); err != nil {
+			return time.Time{}, err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var next time.Time
+	for _, e := range b.pending.entries {
+		if next.IsZero() || e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+	}
+	return next, nil
+}
+
+//postpone moves the next attempt of a queued job to t without counting an attempt
+func (b *Outbox) postpone(ID string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.pending.entries[ID]
+	if !ok {
+		return nil
+	}
+	moved := *e
+	moved.NextAttempt = t
+	return b.pending.put(&moved)
+}
+
+//due returns copies of the entries due now, oldest first
+func (b *Outbox) due() []OutboxEntry {
+	now := b.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []OutboxEntry
+	for _, e := range b.pending.entries {
+		if !e.NextAttempt.After(now) {
+			ret = append(ret, *e)
+		}
+	}
+	sortEntries(ret)
+	return ret
+}
+
+//record writes the outcome of an attempt at e to disk
+func (b *Outbox) record(e OutboxEntry, c oauth.Channel, status Status, err error) error {
+	retryable := b.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	e.Attempts++
+	res := Result{
+		Recipient: e.Job.recipient(),
+		Status:    status,
+		Channel:   c,
+		Attempts:  e.Attempts,
+		Err:       err,
+	}
+
+	done, storeErr := b.update(&e, status, err, retryable)
+	if storeErr != nil {
+		return storeErr
+	}
+	//Outside the lock, OnResult may well look at the Outbox
+	if done && b.OnResult != nil {
+		b.OnResult(e, res)
+	}
+	return nil
+}
+
+//update stores e after an attempt, done tells whether it left the queue
+func (b *Outbox) update(e *OutboxEntry, status Status, err error, retryable func(error) bool) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	//Dropped by an operator in the meantime
+	if _, ok := b.pending.entries[e.ID]; !ok {
+		return false, nil
+	}
+	if err != nil {
+		e.LastError = err.Error()
+	}
+	done := true
+	if status == StatusFailed {
+		if e.Attempts < b.MaxAttempts && retryable(err) {
+			e.NextAttempt = b.Now().Add(backoff(b.BaseDelay, b.MaxDelay, e.Attempts))
+			done = false
+		} else if err := b.dead.put(e); err != nil {
+			return false, err
+		}
+	}
+	//A crash right after moving e to the dead-letter file leaves it in both, rather than in none
+	if done {
+		return true, b.pending.del(e.ID)
+	}
+	return false, b.pending.put(e)
+}
+
+func sortEntries(entries []OutboxEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+}
+
+func listEntries(entries map[string]*OutboxEntry) []OutboxEntry {
+	ret := make([]OutboxEntry, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, *e)
+	}
+	sortEntries(ret)
+	return ret
+}
+
+//Pending lists the queued jobs, oldest first
+func (b *Outbox) Pending() []OutboxEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return listEntries(b.pending.entries)
+}
+
+//DeadLetters lists the jobs that gave up, oldest first
+func (b *Outbox) DeadLetters() []OutboxEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return listEntries(b.dead.entries)
+}
+
+//Replay moves dead letters back into the queue with a fresh attempt count, all of them without IDs
+func (b *Outbox) Replay(IDs ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(IDs) == 0 {
+		for id := range b.dead.entries {
+			IDs = append(IDs, id)
+		}
+	}
+	for _, id := range IDs {
+		if _, ok := b.dead.entries[id]; !ok {
+			return ErrEntryNotFound
+		}
+	}
+	if len(IDs) == 0 {
+		return nil
+	}
+	now := b.Now()
+	entries := make([]*OutboxEntry, 0, len(IDs))
+	for _, id := range IDs {
+		e := *b.dead.entries[id]
+		e.Attempts = 0
+		e.NextAttempt = holdUntil(&e.Job, now, b.QuietHours, b.SalesQuietHours)
+		entries = append(entries, &e)
+	}
+	//The queue is written first, a crash in between leaves a job in both files rather than in none
+	if err := b.pending.put(entries...); err != nil {
+		return err
+	}
+	if err := b.dead.del(IDs...); err != nil {
+		return err
+	}
+	b.notify()
+	return nil
+}
+
+//Drop deletes jobs from the queue or the dead-letter file for good
+func (b *Outbox) Drop(IDs ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var fromPending, fromDead []string
+	for _, id := range IDs {
+		if _, ok := b.pending.entries[id]; ok {
+			fromPending = append(fromPending, id)
+		} else if _, ok := b.dead.entries[id]; ok {
+			fromDead = append(fromDead, id)
+		} else {
+			return ErrEntryNotFound
+		}
+	}
+	if len(fromPending) > 0 {
+		if err := b.pending.del(fromPending...); err != nil {
+			return err
+		}
+	}
+	if len(fromDead) > 0 {
+		return b.dead.del(fromDead...)
+	}
+	return nil
+}
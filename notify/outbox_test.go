@@ -0,0 +1,200 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/notify"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+const notificationsPath = "/oauth_ability/notifications"
+
+//newSSO returns the OAuth of the client "app" and a token for each of n users allowing email
+func newSSO(t *testing.T, n int) (*ssotest.Server, *oauth.OAuth, []*oauth.OAuthToken) {
+	t.Helper()
+	srv := ssotest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddClient("app", "s3cret")
+	o := oauth.NewClient(srv.API(), oauth.ClientConfig{
+		ClientID:     "app",
+		ClientSecret: "s3cret",
+		Store:        tokenstore.NewMemory(),
+	})
+	tokens := make([]*oauth.OAuthToken, n)
+	for i := range tokens {
+		srv.AddUser(user.UserEntity{
+			UID:      i + 1,
+			Username: fmt.Sprintf("user%d", i+1),
+			Email:    fmt.Sprintf("user%d@example.com", i+1),
+		}, "secret")
+		mask := srv.AddMask(user.MaskIDEntity{
+			MaskId:   fmt.Sprintf("m%d", i+1),
+			ClientID: "app",
+			UID:      i + 1,
+			Settings: user.UserSettingEntity{AllowEmailNotifications: true},
+		})
+		code := srv.IssueAuthCode("app", mask.MaskId, []string{string(oauth.ScopeNotifications)}, "", "")
+		token, err := o.NewSession().Exchange(context.Background(), code, "")
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		tokens[i] = token
+	}
+	return srv, o, tokens
+}
+
+//runUntil runs b until it reported n results and returns them
+func runUntil(t *testing.T, b *notify.Outbox, n int) []notify.Result {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var results []notify.Result
+	b.OnResult = func(e notify.OutboxEntry, res notify.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		if results = append(results, res); len(results) == n {
+			cancel()
+		}
+	}
+	b.Run(ctx)
+	b.OnResult = nil
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != n {
+		t.Fatalf("%d results before the timeout, want %d", len(results), n)
+	}
+	return results
+}
+
+func message(text string) oauth.Notification {
+	return oauth.Notification{Title: "hi", Content: text}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	srv, o, tokens := newSSO(t, 1)
+	path := filepath.Join(t.TempDir(), "outbox")
+	b, err := notify.NewOutbox(o, path)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer func() { b.Close() }()
+
+	//A rejected message is not worth retrying
+	srv.InjectError("POST", notificationsPath, 400, common.REQUEST_PARAM_FORMAT_ERROR)
+	id, err := b.Enqueue(notify.Job{Token: tokens[0], Message: message("rejected")})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if res := runUntil(t, b, 1); res[0].Status != notify.StatusFailed || res[0].Attempts != 1 {
+		t.Fatalf("result %+v, want failed after one attempt", res[0])
+	}
+	dead := b.DeadLetters()
+	if len(dead) != 1 || dead[0].ID != id || dead[0].LastError == "" || len(b.Pending()) != 0 {
+		t.Fatalf("dead letters %+v and %d pending, want the job dead", dead, len(b.Pending()))
+	}
+
+	//Dead letters survive a restart and can be sent again
+	b.Close()
+	if b, err = notify.NewOutbox(o, path); err != nil {
+		t.Fatalf("NewOutbox after restart: %v", err)
+	}
+	if len(b.DeadLetters()) != 1 {
+		t.Fatalf("%d dead letters after restart, want 1", len(b.DeadLetters()))
+	}
+	if err := b.Replay(id); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if pending := b.Pending(); len(pending) != 1 || pending[0].Attempts != 0 || len(b.DeadLetters()) != 0 {
+		t.Fatalf("pending %+v after Replay, want the job with a fresh attempt count", pending)
+	}
+	if res := runUntil(t, b, 1); res[0].Status != notify.StatusSent {
+		t.Fatalf("result %+v after Replay, want sent", res[0])
+	}
+	if n := len(srv.Notifications()); n != 1 {
+		t.Fatalf("%d notifications were sent, want 1", n)
+	}
+	if err := b.Replay("unknown"); !errors.Is(err, notify.ErrEntryNotFound) {
+		t.Fatalf("Replay of an unknown ID: got %v, want ErrEntryNotFound", err)
+	}
+}
+
+func TestOutboxDrop(t *testing.T) {
+	_, o, tokens := newSSO(t, 1)
+	path := filepath.Join(t.TempDir(), "outbox")
+	b, err := notify.NewOutbox(o, path)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer func() { b.Close() }()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := b.Schedule(notify.Job{Token: tokens[0], Message: message("later")}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Schedule: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := b.Drop(ids[0], ids[2]); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	if err := b.Drop(ids[0]); !errors.Is(err, notify.ErrEntryNotFound) {
+		t.Fatalf("second Drop: got %v, want ErrEntryNotFound", err)
+	}
+
+	b.Close()
+	if b, err = notify.NewOutbox(o, path); err != nil {
+		t.Fatalf("NewOutbox after restart: %v", err)
+	}
+	pending := b.Pending()
+	if len(pending) != 1 || pending[0].ID != ids[1] {
+		t.Fatalf("pending %+v after restart, want only %s", pending, ids[1])
+	}
+	//The job was queued by its key, the token is in the Store
+	if pending[0].Job.Token != nil || pending[0].Job.TokenKey == nil {
+		t.Fatalf("job %+v was queued with its token", pending[0].Job)
+	}
+}
+
+func TestOutboxSurvivesCompaction(t *testing.T) {
+	_, o, tokens := newSSO(t, 1)
+	path := filepath.Join(t.TempDir(), "outbox")
+	b, err := notify.NewOutbox(o, path)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	defer func() { b.Close() }()
+	//Enough churn for the journal to be rewritten at least once
+	var kept string
+	for i := 0; i < 1200; i++ {
+		id, err := b.Schedule(notify.Job{Token: tokens[0], Message: message(fmt.Sprint(i))}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Schedule: %v", err)
+		}
+		if i == 10 {
+			kept = id
+			continue
+		}
+		if err := b.Drop(id); err != nil {
+			t.Fatalf("Drop: %v", err)
+		}
+	}
+
+	b.Close()
+	if b, err = notify.NewOutbox(o, path); err != nil {
+		t.Fatalf("NewOutbox after restart: %v", err)
+	}
+	if pending := b.Pending(); len(pending) != 1 || pending[0].ID != kept || pending[0].Job.Message.Content != "10" {
+		t.Fatalf("pending %+v after restart, want only %s", pending, kept)
+	}
+}
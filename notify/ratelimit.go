@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//limiter spaces events at least interval apart, shared by all goroutines using it
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+//newLimiter allows PerSecond events a second, nil for no limit
+func newLimiter(PerSecond float64) *limiter {
+	if PerSecond <= 0 {
+		return nil
+	}
+	return &limiter{
+		interval: time.Duration(float64(time.Second) / PerSecond),
+	}
+}
+
+//wait blocks until the next slot, a nil limiter never blocks
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+	return sleep(ctx, slot.Sub(now))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+)
+
+//QuietHours is a daily window in the recipient's time zone during which nothing is sent,
+//e.g. Start "22:00" and End "07:00". Start equal to End is no window at all.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+//DefaultSalesQuietHours keeps sales messages to daytime
+var DefaultSalesQuietHours = &QuietHours{
+	Start: "20:00",
+	End:   "09:00",
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("quiet hours: %q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *QuietHours) Validate() error {
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	_, err := parseClock(q.End)
+	return err
+}
+
+//Until returns when the window around t ends, t itself if t is outside of it
+func (q *QuietHours) Until(t time.Time, loc *time.Location) time.Time {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return t
+	}
+	end, err := parseClock(q.End)
+	if err != nil || start == end {
+		return t
+	}
+	lt := t.In(loc)
+	m := lt.Hour()*60 + lt.Minute()
+	endOfDay := func(days int) time.Time {
+		u := time.Date(lt.Year(), lt.Month(), lt.Day()+days, end/60, end%60, 0, 0, loc)
+		//When the clocks go back the end comes twice, t past the first one waits for the second
+		if !u.After(t) {
+			_, before := u.Zone()
+			_, after := u.Add(3 * time.Hour).Zone()
+			if before > after {
+				u = u.Add(time.Duration(before-after) * time.Second)
+			}
+		}
+		return u
+	}
+	if start < end {
+		if m >= start && m < end {
+			return endOfDay(0)
+		}
+		return t
+	}
+	//The window wraps around midnight
+	if m >= start {
+		return endOfDay(1)
+	}
+	if m < end {
+		return endOfDay(0)
+	}
+	return t
+}
+
+//location of the recipient of j, UTC if unknown
+func (j *Job) location() (*time.Location, error) {
+	if j.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(j.TimeZone)
+}
+
+//validateSchedule checks TimeZone and QuietHours of j
+func (j *Job) validateSchedule() error {
+	if _, err := j.location(); err != nil {
+		return err
+	}
+	if j.QuietHours != nil {
+		return j.QuietHours.Validate()
+	}
+	return nil
+}
+
+//quietHours are the windows j has to respect: its own or the default one,
+//and for sales messages the sales window on top
+func quietHours(j *Job, Default, Sales *QuietHours) []*QuietHours {
+	var ret []*QuietHours
+	if j.QuietHours != nil {
+		ret = append(ret, j.QuietHours)
+	} else if Default != nil {
+		ret = append(ret, Default)
+	}
+	if j.Message.IsSales && Sales != nil {
+		ret = append(ret, Sales)
+	}
+	return ret
+}
+
+//holdUntil returns the earliest time from now on j may be sent at,
+//Default and Sales are the QuietHours and SalesQuietHours of the sender
+func holdUntil(j *Job, now time.Time, Default, Sales *QuietHours) time.Time {
+	t := now
+	if j.SendAt.After(t) {
+		t = j.SendAt
+	}
+	loc, err := j.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	windows := quietHours(j, Default, Sales)
+	//Leaving one window may land in another, a few rounds settle it
+	for i := 0; i < 2*len(windows); i++ {
+		moved := false
+		for _, q := range windows {
+			if u := q.Until(t, loc); u.After(t) {
+				t, moved = u, true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
@@ -0,0 +1,61 @@
+package notify_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/notify"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	utc := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	day := &notify.QuietHours{Start: "12:00", End: "14:00"}
+	night := &notify.QuietHours{Start: "22:00", End: "07:00"}
+	tests := []struct {
+		name  string
+		q     *notify.QuietHours
+		loc   *time.Location
+		t     string
+		until string
+	}{
+		{"before a daytime window", day, time.UTC, "2024-05-01T11:59:00Z", "2024-05-01T11:59:00Z"},
+		{"in a daytime window", day, time.UTC, "2024-05-01T13:00:00Z", "2024-05-01T14:00:00Z"},
+		{"at the end of a window", day, time.UTC, "2024-05-01T14:00:00Z", "2024-05-01T14:00:00Z"},
+		{"before midnight", night, time.UTC, "2024-05-01T23:30:00Z", "2024-05-02T07:00:00Z"},
+		{"after midnight", night, time.UTC, "2024-05-02T03:00:00Z", "2024-05-02T07:00:00Z"},
+		{"across the end of a month", night, time.UTC, "2024-04-30T22:00:00Z", "2024-05-01T07:00:00Z"},
+		{"outside a night window", night, time.UTC, "2024-05-01T21:59:00Z", "2024-05-01T21:59:00Z"},
+		{"no window", &notify.QuietHours{Start: "10:00", End: "10:00"}, time.UTC, "2024-05-01T10:00:00Z", "2024-05-01T10:00:00Z"},
+		//23:00 in Shanghai, UTC+8
+		{"in another zone", night, shanghai, "2024-05-01T15:00:00Z", "2024-05-01T23:00:00Z"},
+		//12:00 UTC is 20:00 in Shanghai, outside the window
+		{"outside in another zone", night, shanghai, "2024-05-01T12:00:00Z", "2024-05-01T12:00:00Z"},
+		//22:30 EST, the night is an hour short as the clocks go forward
+		{"into summer time", night, newYork, "2024-03-10T03:30:00Z", "2024-03-10T11:00:00Z"},
+		//22:30 EDT, the night is an hour long as the clocks go back
+		{"into winter time", night, newYork, "2024-11-03T02:30:00Z", "2024-11-03T12:00:00Z"},
+		//01:15 EST on the second pass through 01:00-02:00, the end at 01:30 EDT is past already
+		{"in the repeated hour", &notify.QuietHours{Start: "00:30", End: "01:30"}, newYork, "2024-11-03T06:15:00Z", "2024-11-03T06:30:00Z"},
+		//01:45 EDT on the first pass, outside the window until the clocks go back
+		{"before the repeated hour", &notify.QuietHours{Start: "00:30", End: "01:30"}, newYork, "2024-11-03T05:45:00Z", "2024-11-03T05:45:00Z"},
+	}
+	for _, tt := range tests {
+		if got := tt.q.Until(utc(tt.t), tt.loc); !got.Equal(utc(tt.until)) {
+			t.Errorf("%s: Until(%s) = %s, want %s", tt.name, tt.t, got.UTC().Format(time.RFC3339), tt.until)
+		}
+	}
+}
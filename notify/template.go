@@ -0,0 +1,258 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+var ErrTemplateNotFound = errors.New("notification template not found")
+
+//VariableError is returned when a template uses a variable it doesn't declare,
+//or a render lacks a declared one
+type VariableError struct {
+	Template string
+	Locale   string
+	Variable string
+	//True when the template uses an undeclared variable, false when a render lacks a required one
+	Undeclared bool
+}
+
+func (e *VariableError) Error() string {
+	if e.Undeclared {
+		return fmt.Sprintf("notification template %s (%s) uses undeclared variable %s", e.Template, e.Locale, e.Variable)
+	}
+	return fmt.Sprintf("notification template %s (%s) needs variable %s", e.Template, e.Locale, e.Variable)
+}
+
+//Vars are the values a template is rendered with, {{.Name}} refers to Vars["Name"]
+type Vars map[string]interface{}
+
+//Template is one locale variant of a notification
+type Template struct {
+	Name string
+	//BCP 47 tag like "en" or "zh-Hans-CN", "_" works as separator too
+	Locale  string
+	Title   string
+	Content string
+	//Variables every render must supply, the only ones the template may use outside with and range
+	Required []string
+	IsSales  bool
+}
+
+type compiledTemplate struct {
+	Template
+	title   *template.Template
+	content *template.Template
+}
+
+//TemplateRegistry holds notification templates by name and locale.
+//A locale without a variant falls back to its parents ("zh-Hans-CN", "zh-Hans", "zh")
+//and then to Fallback in order.
+type TemplateRegistry struct {
+	Fallback []string
+	//Attribute RenderFor reads the locale from
+	LocaleAttribute string
+
+	mu        sync.RWMutex
+	templates map[string]map[string]*compiledTemplate
+}
+
+func NewTemplateRegistry(Fallback ...string) *TemplateRegistry {
+	return &TemplateRegistry{
+		Fallback:        Fallback,
+		LocaleAttribute: "locale",
+		templates:       map[string]map[string]*compiledTemplate{},
+	}
+}
+
+func normalizeLocale(Locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(Locale), "_", "-", -1))
+}
+
+//Register parses t and checks it uses no variable beyond t.Required.
+//A variant registered before for the same name and locale is replaced.
+func (r *TemplateRegistry) Register(t Template) error {
+	//Chain never yields an empty locale, a variant registered under one could never be found
+	if t.Name == "" || normalizeLocale(t.Locale) == "" || t.Title == "" || t.Content == "" {
+		return fmt.Errorf("notification template %q needs a name, locale, title and content", t.Name)
+	}
+	c := &compiledTemplate{Template: t}
+	c.Locale = normalizeLocale(t.Locale)
+	c.Required = append([]string(nil), t.Required...)
+	var err error
+	if c.title, err = template.New(t.Name + ".title").Option("missingkey=error").Parse(t.Title); err != nil {
+		return err
+	}
+	if c.content, err = template.New(t.Name + ".content").Option("missingkey=error").Parse(t.Content); err != nil {
+		return err
+	}
+	declared := map[string]bool{}
+	for _, v := range c.Required {
+		declared[v] = true
+	}
+	for _, tmpl := range []*template.Template{c.title, c.content} {
+		for _, v := range usedVariables(tmpl.Tree.Root) {
+			if !declared[v] {
+				return &VariableError{
+					Template:   t.Name,
+					Locale:     c.Locale,
+					Variable:   v,
+					Undeclared: true,
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.templates[t.Name] == nil {
+		r.templates[t.Name] = map[string]*compiledTemplate{}
+	}
+	r.templates[t.Name][c.Locale] = c
+	return nil
+}
+
+//usedVariables lists the fields of dot a template refers to, directly or through $.
+//Inside with and range dot is something else, those bodies are only looked into for $.
+func usedVariables(n parse.Node) []string {
+	var ret []string
+	var walk func(n parse.Node, root bool)
+	walk = func(n parse.Node, root bool) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, v := range n.Nodes {
+				walk(v, root)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, root)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				for _, arg := range cmd.Args {
+					walk(arg, root)
+				}
+			}
+		case *parse.FieldNode:
+			if root {
+				ret = append(ret, n.Ident[0])
+			}
+		case *parse.VariableNode:
+			//$ is the data the template was executed with, wherever it is used
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				ret = append(ret, n.Ident[1])
+			}
+		case *parse.ChainNode:
+			walk(n.Node, root)
+		case *parse.IfNode:
+			walk(n.Pipe, root)
+			walk(n.List, root)
+			walk(n.ElseList, root)
+		case *parse.RangeNode:
+			walk(n.Pipe, root)
+			walk(n.List, false)
+			walk(n.ElseList, root)
+		case *parse.WithNode:
+			walk(n.Pipe, root)
+			walk(n.List, false)
+			walk(n.ElseList, root)
+		case *parse.TemplateNode:
+			walk(n.Pipe, root)
+		}
+	}
+	walk(n, true)
+	return ret
+}
+
+//Chain returns the locales looked at for Locale, in order
+func (r *TemplateRegistry) Chain(Locale string) []string {
+	var ret []string
+	add := func(l string) {
+		for _, v := range ret {
+			if v == l {
+				return
+			}
+		}
+		ret = append(ret, l)
+	}
+	for l := normalizeLocale(Locale); l != ""; {
+		add(l)
+		i := strings.LastIndex(l, "-")
+		if i < 0 {
+			break
+		}
+		l = l[:i]
+	}
+	for _, l := range r.Fallback {
+		add(normalizeLocale(l))
+	}
+	return ret
+}
+
+//Lookup returns the variant of name that Locale ends up with
+func (r *TemplateRegistry) Lookup(name, Locale string) (*Template, error) {
+	c, err := r.lookup(name, Locale)
+	if err != nil {
+		return nil, err
+	}
+	t := c.Template
+	return &t, nil
+}
+
+func (r *TemplateRegistry) lookup(name, Locale string) (*compiledTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	variants := r.templates[name]
+	for _, l := range r.Chain(Locale) {
+		if c, ok := variants[l]; ok {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s (%s)", ErrTemplateNotFound, name, Locale)
+}
+
+//Render fills the variant of name for Locale with vars.
+//The result carries Title, Content and IsSales, the rest of the Notification is up to the caller.
+func (r *TemplateRegistry) Render(name, Locale string, vars Vars) (oauth.Notification, error) {
+	c, err := r.lookup(name, Locale)
+	if err != nil {
+		return oauth.Notification{}, err
+	}
+	for _, v := range c.Required {
+		if _, ok := vars[v]; !ok {
+			return oauth.Notification{}, &VariableError{
+				Template: c.Name,
+				Locale:   c.Locale,
+				Variable: v,
+			}
+		}
+	}
+	var title, content bytes.Buffer
+	if err := c.title.Execute(&title, vars); err != nil {
+		return oauth.Notification{}, err
+	}
+	if err := c.content.Execute(&content, vars); err != nil {
+		return oauth.Notification{}, err
+	}
+	return oauth.Notification{
+		Title:   title.String(),
+		Content: content.String(),
+		IsSales: c.IsSales,
+	}, nil
+}
+
+//RenderFor is Render with the locale taken from attrs[r.LocaleAttribute], e.g. a field of your user profile
+func (r *TemplateRegistry) RenderFor(name string, attrs map[string]string, vars Vars) (oauth.Notification, error) {
+	return r.Render(name, attrs[r.LocaleAttribute], vars)
+}
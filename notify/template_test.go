@@ -0,0 +1,74 @@
+package notify_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/notify"
+)
+
+func TestTemplateNeedsLocale(t *testing.T) {
+	r := notify.NewTemplateRegistry("en")
+	for _, Locale := range []string{"", "  "} {
+		err := r.Register(notify.Template{Name: "welcome", Locale: Locale, Title: "Hi", Content: "Welcome"})
+		if err == nil {
+			t.Fatalf("Register with locale %q succeeded", Locale)
+		}
+	}
+	if _, err := r.Lookup("welcome", ""); !errors.Is(err, notify.ErrTemplateNotFound) {
+		t.Fatalf("Lookup: got %v, want ErrTemplateNotFound", err)
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		required   []string
+		undeclared string
+	}{
+		{"field", "{{.Name}}", nil, "Name"},
+		{"field in if", "{{if .Name}}hi{{end}}", nil, "Name"},
+		{"field of range element", "{{range .Items}}{{.Name}}{{end}}", []string{"Items"}, ""},
+		{"$ in range", "{{range .Items}}{{$.Name}}{{end}}", []string{"Items"}, "Name"},
+		{"$ in with", "{{with .Order}}{{.ID}} for {{$.Name}}{{end}}", []string{"Order"}, "Name"},
+		{"$ declared", "{{range .Items}}{{$.Name}}{{end}}", []string{"Items", "Name"}, ""},
+		{"other variable", "{{$n := .Name}}{{range .Items}}{{$n}}{{end}}", []string{"Items", "Name"}, ""},
+	}
+	for _, tt := range tests {
+		r := notify.NewTemplateRegistry()
+		err := r.Register(notify.Template{Name: "t", Locale: "en", Title: "Hi", Content: tt.content, Required: tt.required})
+		var varErr *notify.VariableError
+		switch {
+		case tt.undeclared == "" && err != nil:
+			t.Errorf("%s: Register: %v", tt.name, err)
+		case tt.undeclared != "" && (!errors.As(err, &varErr) || !varErr.Undeclared || varErr.Variable != tt.undeclared):
+			t.Errorf("%s: Register: got %v, want %s undeclared", tt.name, err, tt.undeclared)
+		}
+	}
+}
+
+func TestTemplateRenderWithRoot(t *testing.T) {
+	r := notify.NewTemplateRegistry("en")
+	err := r.Register(notify.Template{
+		Name:     "digest",
+		Locale:   "en",
+		Title:    "Digest",
+		Content:  "{{range .Items}}{{.}} for {{$.Name}};{{end}}",
+		Required: []string{"Items", "Name"},
+	})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	n, err := r.Render("digest", "en-US", notify.Vars{"Items": []string{"a", "b"}, "Name": "Ann"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if n.Content != "a for Ann;b for Ann;" {
+		t.Fatalf("Content is %q", n.Content)
+	}
+	var varErr *notify.VariableError
+	if _, err := r.Render("digest", "en", notify.Vars{"Items": []string{"a"}}); !errors.As(err, &varErr) || varErr.Variable != "Name" {
+		t.Fatalf("Render without Name: got %v, want a VariableError for Name", err)
+	}
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+//Token sources kept by default, a source left out loads the token from the Store again
+const maxTokenSources = 10000
+
+type tokenSource struct {
+	key common.TokenKey
+	src *oauth.RefreshingTokenSource
+	//Calls using src right now, a source is only dropped when idle so that
+	//no second source refreshes the same token at the same time
+	busy int
+}
+
+//tokenSources resolves the TokenKey of jobs through the Store of an OAuth,
+//with one RefreshingTokenSource per key so that a token is refreshed once for all its jobs.
+//The least recently used sources are dropped beyond max.
+type tokenSources struct {
+	//Clock of the sources, time.Now if nil
+	now func() time.Time
+	//maxTokenSources if 0
+	max int
+
+	mu      sync.Mutex
+	lru     *list.List
+	sources map[common.TokenKey]*list.Element
+}
+
+//token returns the token to send j with
+func (s *tokenSources) token(ctx context.Context, o *oauth.OAuth, j *Job) (*oauth.OAuthToken, error) {
+	if j.TokenKey == nil {
+		if j.Token == nil {
+			return nil, common.ParamsError
+		}
+		return j.Token, nil
+	}
+	key := *j.TokenKey
+	if key.MaskID == "" || key.ClientID != o.ClientID() {
+		return nil, common.ParamsError
+	}
+	s.mu.Lock()
+	if s.sources == nil {
+		s.lru = list.New()
+		s.sources = map[common.TokenKey]*list.Element{}
+	}
+	el, ok := s.sources[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	} else {
+		src, err := oauth.NewStoredTokenSource(o, key.MaskID, "")
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if s.now != nil {
+			src.Now = s.now
+		}
+		el = s.lru.PushFront(&tokenSource{key: key, src: src})
+		s.sources[key] = el
+	}
+	e := el.Value.(*tokenSource)
+	e.busy++
+	s.evict()
+	s.mu.Unlock()
+
+	t, err := e.src.Token(ctx)
+
+	s.mu.Lock()
+	e.busy--
+	if errors.Is(err, oauth.ErrReauthorizationRequired) && s.sources[key] == el {
+		//The user may authorize again, the next job loads whatever is stored by then
+		s.remove(el)
+	}
+	s.mu.Unlock()
+	return t, err
+}
+
+//evict expects s.mu to be held
+func (s *tokenSources) evict() {
+	max := s.max
+	if max <= 0 {
+		max = maxTokenSources
+	}
+	for el := s.lru.Back(); el != nil && s.lru.Len() > max; {
+		prev := el.Prev()
+		if el.Value.(*tokenSource).busy == 0 {
+			s.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (s *tokenSources) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.sources, el.Value.(*tokenSource).key)
+}
@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//storedTokens stores a token for each of n masks of the client "app"
+func storedTokens(t *testing.T, n int) (*oauth.OAuth, []common.TokenKey) {
+	t.Helper()
+	srv := ssotest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddClient("app", "s3cret")
+	o := oauth.NewClient(srv.API(), oauth.ClientConfig{
+		ClientID:     "app",
+		ClientSecret: "s3cret",
+		Store:        tokenstore.NewMemory(),
+	})
+	keys := make([]common.TokenKey, n)
+	for i := range keys {
+		srv.AddUser(user.UserEntity{UID: i + 1, Username: fmt.Sprintf("user%d", i+1)}, "secret")
+		mask := srv.AddMask(user.MaskIDEntity{MaskId: fmt.Sprintf("m%d", i+1), ClientID: "app", UID: i + 1})
+		code := srv.IssueAuthCode("app", mask.MaskId, nil, "", "")
+		if _, err := o.NewSession().Exchange(context.Background(), code, ""); err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		keys[i] = common.OAuthTokenKey("app", mask.MaskId)
+	}
+	return o, keys
+}
+
+func TestTokenSourcesBounded(t *testing.T) {
+	o, keys := storedTokens(t, 3)
+	s := &tokenSources{max: 2}
+	for _, i := range []int{0, 1, 0, 2} {
+		if _, err := s.token(context.Background(), o, &Job{TokenKey: &keys[i]}); err != nil {
+			t.Fatalf("token of %s: %v", keys[i].MaskID, err)
+		}
+	}
+	if len(s.sources) != 2 || s.lru.Len() != 2 {
+		t.Fatalf("%d sources kept, want 2", len(s.sources))
+	}
+	//keys[1] was used least recently
+	if _, ok := s.sources[keys[1]]; ok {
+		t.Fatal("the least recently used source was kept")
+	}
+	//A dropped source is loaded from the Store again
+	if _, err := s.token(context.Background(), o, &Job{TokenKey: &keys[1]}); err != nil {
+		t.Fatalf("token after eviction: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package oauth
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+//Path of the consent page on the APIServer
+var AuthorizePath = "/authcode"
+
+var (
+	ErrInvalidRedirectURI    = errors.New("redirect_uri must be an absolute URL without fragment")
+	ErrRedirectURINotAllowed = errors.New("redirect_uri is not registered for this client")
+	ErrInvalidCodeChallenge  = errors.New("code_challenge_type must be S256 or plain")
+	ErrClientMismatch        = errors.New("client_id is not the one of this client")
+)
+
+//AuthorizeRequest is what sends a user to the consent page.
+//After consent the SSO redirects to RedirectURI with code and state.
+type AuthorizeRequest struct {
+	ClientID    string
+	Scope       Scopes
+	RedirectURI string
+	State       string
+	//Optional PKCE parameters, CodeChallengeType is S256 or plain
+	CodeChallenge     string
+	CodeChallengeType string
+}
+
+//Validate checks r, and RedirectURI against AllowedRedirectURIs.
+//Redirect URIs are compared exactly, as recommended for OAuth 2.0. Without any
+//AllowedRedirectURIs no RedirectURI is allowed, a forgotten registration must not
+//let the code go wherever a request says.
+func (r *AuthorizeRequest) Validate(AllowedRedirectURIs []string) error {
+	if r.ClientID == "" || r.RedirectURI == "" {
+		return common.ParamsError
+	}
+	u, err := url.Parse(r.RedirectURI)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return ErrInvalidRedirectURI
+	}
+	allowed := false
+	for _, v := range AllowedRedirectURIs {
+		if v == r.RedirectURI {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return ErrRedirectURINotAllowed
+	}
+	if r.CodeChallenge != "" && r.CodeChallengeType != ChallengeS256 && r.CodeChallengeType != ChallengePlain {
+		return ErrInvalidCodeChallenge
+	}
+	return nil
+}
+
+//Query returns the escaped query string of the authorization URL
+func (r *AuthorizeRequest) Query() string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", r.ClientID)
+	q.Set("redirect_uri", r.RedirectURI)
+	if len(r.Scope) > 0 {
+		q.Set("scope", r.Scope.String())
+	}
+	if r.State != "" {
+		q.Set("state", r.State)
+	}
+	if r.CodeChallenge != "" {
+		q.Set("code_challenge", r.CodeChallenge)
+		q.Set("code_challenge_type", r.CodeChallengeType)
+	}
+	return q.Encode()
+}
+
+//URL validates r and builds the authorization URL on APIServer
+func (r *AuthorizeRequest) URL(APIServer string, AllowedRedirectURIs []string) (string, error) {
+	if err := r.Validate(AllowedRedirectURIs); err != nil {
+		return "", err
+	}
+	return APIServer + AuthorizePath + "?" + r.Query(), nil
+}
+
+//AuthorizeURL builds the authorization URL on the configured APIServer.
+//An empty r.ClientID or r.Scope is taken from the configuration of o, r.RedirectURI must be
+//one of its RedirectURIs. Another r.ClientID is ErrClientMismatch, the RedirectURIs of o
+//say nothing about where the codes of other clients may go.
+//See Session.AuthorizeURL to have the PKCE taken care of.
+func (o *OAuth) AuthorizeURL(r AuthorizeRequest) (string, error) {
+	c := o.client()
+	if r.ClientID == "" {
+		r.ClientID = c.ClientID
+	} else if r.ClientID != c.ClientID {
+		return "", ErrClientMismatch
+	}
+	if len(r.Scope) == 0 {
+		r.Scope = c.Scope
+	}
+	if err := r.Validate(c.RedirectURIs); err != nil {
+		return "", err
+	}
+	return o.API.GetFormatURL(AuthorizePath) + "?" + r.Query(), nil
+}
@@ -0,0 +1,22 @@
+package oauth_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+func TestAuthorizeURLRejectsOtherClient(t *testing.T) {
+	_, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+
+	if _, err := o.AuthorizeURL(oauth.AuthorizeRequest{ClientID: "other", RedirectURI: redirectURI}); !errors.Is(err, oauth.ErrClientMismatch) {
+		t.Fatalf("AuthorizeURL for another client: got %v, want ErrClientMismatch", err)
+	}
+	if _, err := o.NewSession().AuthorizeURL(oauth.AuthorizeRequest{ClientID: "other", RedirectURI: redirectURI}); !errors.Is(err, oauth.ErrClientMismatch) {
+		t.Fatalf("Session.AuthorizeURL for another client: got %v, want ErrClientMismatch", err)
+	}
+	if _, err := o.AuthorizeURL(oauth.AuthorizeRequest{ClientID: "app", RedirectURI: redirectURI}); err != nil {
+		t.Fatalf("AuthorizeURL for its own client: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMissingBearerToken = errors.New("bearer token missing")
+	ErrInvalidBearerToken = errors.New("bearer token invalid or expired")
+	ErrInsufficientScope  = errors.New("token lacks a required scope")
+	//RFC 6750 forbids sending the token in more than one way
+	ErrMultipleBearerTokens = errors.New("bearer token sent more than once")
+)
+
+type tokenContextKey struct{}
+
+//WithToken returns a copy of ctx carrying t, see TokenFromContext
+func WithToken(ctx context.Context, t *OAuthToken) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, t)
+}
+
+//TokenFromContext returns the token BearerAuth verified for the request
+func TokenFromContext(ctx context.Context) (*OAuthToken, bool) {
+	t, ok := ctx.Value(tokenContextKey{}).(*OAuthToken)
+	return t, ok && t != nil
+}
+
+func MaskIDFromContext(ctx context.Context) string {
+	if t, ok := TokenFromContext(ctx); ok {
+		return t.MaskID
+	}
+	return ""
+}
+
+func ClientIDFromContext(ctx context.Context) string {
+	if t, ok := TokenFromContext(ctx); ok {
+		return t.ClientID
+	}
+	return ""
+}
+
+func ScopeFromContext(ctx context.Context) Scopes {
+	if t, ok := TokenFromContext(ctx); ok {
+		return t.Scopes()
+	}
+	return nil
+}
+
+//BearerAuth protects a resource server: every request must bring an access token
+//issued to the client of the OAuth of Cache, checked with VerifyAccessToken through Cache.
+type BearerAuth struct {
+	Cache *VerifyCache
+	//Query parameter also accepted for the token, empty accepts the Authorization header only
+	QueryParam string
+	//realm of the WWW-Authenticate challenge, optional
+	Realm string
+	//Scopes every request needs, see also RequireScope
+	Scope Scopes
+}
+
+//ClientSecret is optional and sent along with the verification, it defaults to the one of the configuration of o
+func NewBearerAuth(o *OAuth, ClientSecret string, Scope ...Scope) *BearerAuth {
+	return &BearerAuth{
+		Cache:      NewVerifyCache(o, ClientSecret),
+		QueryParam: "access_token",
+		Scope:      Scope,
+	}
+}
+
+//BearerToken extracts the token of r, "" if there is none.
+//An empty QueryParam only looks at the Authorization header.
+func BearerToken(r *http.Request, QueryParam string) (string, error) {
+	var token string
+	if h := r.Header.Get("Authorization"); h != "" {
+		parts := strings.SplitN(h, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", ErrMissingBearerToken
+		}
+		token = strings.TrimSpace(parts[1])
+	}
+	if QueryParam != "" {
+		if v := r.URL.Query().Get(QueryParam); v != "" {
+			if token != "" {
+				return "", ErrMultipleBearerTokens
+			}
+			token = v
+		}
+	}
+	if token == "" {
+		return "", ErrMissingBearerToken
+	}
+	return token, nil
+}
+
+//Handler verifies the token of every request before passing it to next,
+//which finds the token with TokenFromContext
+func (b *BearerAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AccessToken, err := BearerToken(r, b.QueryParam)
+		if err != nil {
+			b.challenge(w, err)
+			return
+		}
+		t, err := b.Cache.Verify(r.Context(), AccessToken)
+		if err != nil {
+			b.challenge(w, err)
+			return
+		}
+		if !t.HasScope(b.Scope...) {
+			b.challenge(w, ErrInsufficientScope, b.Scope...)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithToken(r.Context(), t)))
+	})
+}
+
+//RequireScope wraps a handler behind Handler with an additional scope check
+func (b *BearerAuth) RequireScope(next http.Handler, Scope ...Scope) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := TokenFromContext(r.Context())
+		if !ok {
+			b.challenge(w, ErrMissingBearerToken)
+			return
+		}
+		if !t.HasScope(Scope...) {
+			b.challenge(w, ErrInsufficientScope, Scope...)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//challenge answers as described in RFC 6750 section 3
+func (b *BearerAuth) challenge(w http.ResponseWriter, err error, Scope ...Scope) {
+	var status int
+	var params []string
+	if b.Realm != "" {
+		params = append(params, fmt.Sprintf("realm=%q", b.Realm))
+	}
+	switch {
+	case errors.Is(err, ErrMissingBearerToken):
+		//No error code when the request carries no authentication at all
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrMultipleBearerTokens):
+		status = http.StatusBadRequest
+		params = append(params, `error="invalid_request"`)
+	case errors.Is(err, ErrInvalidBearerToken):
+		status = http.StatusUnauthorized
+		params = append(params, `error="invalid_token"`)
+	case errors.Is(err, ErrInsufficientScope):
+		status = http.StatusForbidden
+		params = append(params, `error="insufficient_scope"`, fmt.Sprintf("scope=%q", Scopes(Scope).String()))
+	default:
+		//The SSO couldn't be asked, that's not the client's fault
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		} else {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	challenge := "Bearer"
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,189 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+//Stages of the authorization-code flow a CallbackError can come from
+const (
+	StageAuthorize = "authorize"
+	StageState     = "state"
+	StageToken     = "token"
+	StageUserInfo  = "user_info"
+)
+
+//CallbackError is what CallbackHandler.OnError receives
+type CallbackError struct {
+	Stage string
+	//HTTP status the default OnError answers with, see CallbackStatus
+	StatusCode int
+	Err        error
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("oauth callback failed at %s: %v", e.Stage, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	//ErrAccessDenied is returned when the SSO redirects back with an error instead of a code
+	ErrAccessDenied = errors.New("authorization denied")
+	//ErrPKCENeedsStateStore is returned by Start when a PKCE verifier would have nowhere to go
+	ErrPKCENeedsStateStore = errors.New("PKCE flows need a StateManager with a Store")
+)
+
+//CallbackStatus maps an error of the flow to the HTTP status shown to the browser.
+//Problems with the request itself are 4xx, failures of the SSO are 502 or 504.
+func CallbackStatus(Stage string, err error) int {
+	if Stage == StageState {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var apiErr *common.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case common.ITEM_NOT_FOUND_ERROR, common.ITEM_EXPIRED_OR_USED_ERROR,
+			common.REQUEST_PARAM_FORMAT_ERROR, common.INNER_ARGUMENT_ERROR:
+			return http.StatusBadRequest
+		case common.CREDENTIAL_NOT_MATCH:
+			return http.StatusUnauthorized
+		case common.PERMISSION_DENIED:
+			return http.StatusForbidden
+		}
+	}
+	if errors.Is(err, ErrMissingCodeVerifier) || errors.Is(err, common.ParamsError) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+//CallbackHandler runs the redirect_uri side of the authorization-code flow:
+//it checks state, exchanges the code, fetches the user info and hands both to OnSuccess.
+//
+//Flows started with Start use PKCE if ClientSecret is empty, the verifier is kept by States.Store.
+//A signed state never carries the verifier, so such flows need States.Store.
+type CallbackHandler struct {
+	OAuth  *OAuth
+	States *StateManager
+	//Identifies the browser session, e.g. by a cookie value. States are bound to it.
+	SessionID    func(r *http.Request) string
+	ClientSecret string
+	//Used by Start
+	RedirectURI string
+	Scope       Scopes
+	//Called after a successful exchange, typically to set the session.
+	//ReturnTo is what was passed to Start, see SafeReturnTo.
+	//Nil redirects to SafeReturnTo(ReturnTo).
+	OnSuccess func(w http.ResponseWriter, r *http.Request, token *OAuthToken, info *OAuthUserInfo, ReturnTo string)
+	//Nil answers with err.StatusCode
+	OnError func(w http.ResponseWriter, r *http.Request, err *CallbackError)
+}
+
+//Start issues a state and redirects the browser to the consent page
+func (h *CallbackHandler) Start(w http.ResponseWriter, r *http.Request, ReturnTo string) error {
+	entry := StateEntry{
+		SessionID: h.SessionID(r),
+		ReturnTo:  ReturnTo,
+	}
+	req := AuthorizeRequest{
+		RedirectURI: h.RedirectURI,
+		Scope:       h.Scope,
+	}
+	if h.ClientSecret == "" {
+		if h.States.Store == nil {
+			return ErrPKCENeedsStateStore
+		}
+		p, err := NewPKCE(ChallengeS256)
+		if err != nil {
+			return err
+		}
+		p.Apply(&req)
+		entry.CodeVerifier = p.Verifier
+	}
+	state, err := h.States.Issue(entry)
+	if err != nil {
+		return err
+	}
+	req.State = state
+	target, err := h.OAuth.AuthorizeURL(req)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+func (h *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		h.fail(w, r, StageAuthorize, fmt.Errorf("%w: %s", ErrAccessDenied, e))
+		return
+	}
+	entry, err := h.States.Verify(q.Get("state"), h.SessionID(r))
+	if err != nil {
+		h.fail(w, r, StageState, err)
+		return
+	}
+	code := q.Get("code")
+	if code == "" {
+		h.fail(w, r, StageToken, common.ParamsError)
+		return
+	}
+
+	//h.OAuth is shared by all requests, the flow goes through a session of its own
+	sess := h.OAuth.ResumeSession(SessionState{
+		CodeVerifier:  entry.CodeVerifier,
+		ChallengeType: ChallengeS256,
+	})
+	token, err := sess.Exchange(r.Context(), code, h.ClientSecret)
+	if err != nil {
+		h.fail(w, r, StageToken, err)
+		return
+	}
+	info, err := sess.UserInfo(r.Context())
+	if err != nil {
+		h.fail(w, r, StageUserInfo, err)
+		return
+	}
+	if h.OnSuccess != nil {
+		h.OnSuccess(w, r, token, info, entry.ReturnTo)
+		return
+	}
+	http.Redirect(w, r, SafeReturnTo(entry.ReturnTo), http.StatusFound)
+}
+
+func (h *CallbackHandler) fail(w http.ResponseWriter, r *http.Request, Stage string, err error) {
+	e := &CallbackError{
+		Stage:      Stage,
+		StatusCode: CallbackStatus(Stage, err),
+		Err:        err,
+	}
+	if h.OnError != nil {
+		h.OnError(w, r, e)
+		return
+	}
+	http.Error(w, http.StatusText(e.StatusCode), e.StatusCode)
+}
+
+//SafeReturnTo returns ReturnTo if it is a path on this site, "/" otherwise.
+//This keeps a crafted ReturnTo from turning the callback into an open redirect.
+func SafeReturnTo(ReturnTo string) string {
+	if !strings.HasPrefix(ReturnTo, "/") || strings.HasPrefix(ReturnTo, "//") || strings.HasPrefix(ReturnTo, "/\\") {
+		return "/"
+	}
+	return ReturnTo
+}
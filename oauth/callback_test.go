@@ -0,0 +1,84 @@
+package oauth_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+)
+
+const sessionCookie = "sess"
+
+func sessionID(r *http.Request) string {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+//roundTrip runs a flow of h from Start to the callback as the owner of MaskID
+//and returns the MaskID of the token OnSuccess got
+func roundTrip(t *testing.T, srv *ssotest.Server, h *oauth.CallbackHandler, MaskID string) string {
+	t.Helper()
+	var got string
+	h.OnSuccess = func(w http.ResponseWriter, r *http.Request, token *oauth.OAuthToken, info *oauth.OAuthUserInfo, ReturnTo string) {
+		if info.MaskID != token.MaskID || ReturnTo != "/home" {
+			t.Errorf("OnSuccess got %+v, %+v, %q", token, info, ReturnTo)
+		}
+		got = token.MaskID
+	}
+	h.OnError = func(w http.ResponseWriter, r *http.Request, err *oauth.CallbackError) {
+		t.Errorf("OnError: %v", err)
+	}
+
+	start := httptest.NewRequest("GET", "/login", nil)
+	start.AddCookie(&http.Cookie{Name: "session", Value: sessionCookie})
+	w := httptest.NewRecorder()
+	if err := h.Start(w, start, "/home"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	back, err := consentRedirect(srv, w.Header().Get("Location"), MaskID)
+	if err != nil {
+		t.Fatalf("consent: %v", err)
+	}
+	callback := httptest.NewRequest("GET", back.String(), nil)
+	callback.AddCookie(&http.Cookie{Name: "session", Value: sessionCookie})
+	h.ServeHTTP(httptest.NewRecorder(), callback)
+	return got
+}
+
+func TestCallbackRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		config oauth.ClientConfig
+		states *oauth.StateManager
+	}{
+		{"secret, key-only states", oauth.ClientConfig{ClientSecret: "s3cret"}, oauth.NewStateManager(nil, key)},
+		{"secret, stored states", oauth.ClientConfig{ClientSecret: "s3cret"}, oauth.NewStateManager(oauth.NewMemoryStateStore(), nil)},
+		{"PKCE, stored states", oauth.ClientConfig{PKCE: true}, oauth.NewStateManager(oauth.NewMemoryStateStore(), nil)},
+		{"PKCE, signed and stored states", oauth.ClientConfig{PKCE: true}, oauth.NewStateManager(oauth.NewMemoryStateStore(), key)},
+	}
+	for _, tt := range tests {
+		srv, o := setup(t, tt.config)
+		h := oauth.NewCallbackHandler(o, tt.states, sessionID)
+		if got := roundTrip(t, srv, h, maskID(1)); got != maskID(1) {
+			t.Errorf("%s: signed in as %q, want %s", tt.name, got, maskID(1))
+		}
+	}
+}
+
+func TestCallbackPKCEWithoutStateStore(t *testing.T) {
+	_, o := setup(t, oauth.ClientConfig{PKCE: true})
+	h := oauth.NewCallbackHandler(o, oauth.NewStateManager(nil, []byte("0123456789abcdef0123456789abcdef")), sessionID)
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: sessionCookie})
+	if err := h.Start(httptest.NewRecorder(), r, "/home"); !errors.Is(err, oauth.ErrPKCENeedsStateStore) {
+		t.Fatalf("Start: got %v, want ErrPKCENeedsStateStore", err)
+	}
+}
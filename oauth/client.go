@@ -0,0 +1,102 @@
+package oauth
+
+import (
+	"net/http"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+//ClientConfig is how a registered client talks to the SSO, see NewClient and api.API.RegisterClient
+type ClientConfig struct {
+	ClientID string
+	//Used wherever a call takes an optional client_secret and none is passed
+	ClientSecret string
+	//Exchange codes with PKCE instead of the secret, implied without a ClientSecret
+	PKCE bool
+	//AuthorizeURL only redirects to these, the first one is used by NewCallbackHandler
+	RedirectURIs []string
+	//Requested by AuthorizeURL when the request names no scope
+	Scope Scopes
+	//Optional, obtained and refreshed tokens are saved to it
+	Store common.TokenStore
+}
+
+//UsesPKCE tells whether code exchanges of the client go without the secret
+func (c ClientConfig) UsesPKCE() bool {
+	return c.PKCE || c.ClientSecret == ""
+}
+
+func (c ClientConfig) copy() *ClientConfig {
+	c.RedirectURIs = append([]string(nil), c.RedirectURIs...)
+	c.Scope = append(Scopes(nil), c.Scope...)
+	return &c
+}
+
+//NewClient returns the OAuth of the client c describes
+func NewClient(API common.Transport, c ClientConfig) *OAuth {
+	return &OAuth{
+		API: API,
+		Token: &OAuthToken{
+			ClientID: c.ClientID,
+		},
+		config: c.copy(),
+	}
+}
+
+//Config returns the configuration of o.
+//An OAuth not created by NewClient has none, its ClientID is taken from o.Token.
+func (o *OAuth) Config() ClientConfig {
+	return *o.client().copy()
+}
+
+func (o *OAuth) ClientID() string {
+	return o.client().ClientID
+}
+
+//Configure replaces the configuration of o, e.g. to rotate the secret, while o stays in use.
+//Calls already on their way finish with the old one. The ClientID can't change.
+func (o *OAuth) Configure(c ClientConfig) error {
+	if c.ClientID == "" {
+		return common.ParamsError
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.config != nil && o.config.ClientID != c.ClientID {
+		return common.ParamsError
+	}
+	o.config = c.copy()
+	return nil
+}
+
+//client returns the configuration in effect, which callers must not change
+func (o *OAuth) client() *ClientConfig {
+	o.mu.RLock()
+	c := o.config
+	o.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	c = &ClientConfig{}
+	if o.Token != nil {
+		c.ClientID = o.Token.ClientID
+	}
+	return c
+}
+
+//NewCallbackHandler sets up a CallbackHandler for o according to its configuration
+func NewCallbackHandler(o *OAuth, States *StateManager, SessionID func(r *http.Request) string) *CallbackHandler {
+	c := o.Config()
+	h := &CallbackHandler{
+		OAuth:     o,
+		States:    States,
+		SessionID: SessionID,
+		Scope:     c.Scope,
+	}
+	if !c.UsesPKCE() {
+		h.ClientSecret = c.ClientSecret
+	}
+	if len(c.RedirectURIs) > 0 {
+		h.RedirectURI = c.RedirectURIs[0]
+	}
+	return h
+}
@@ -0,0 +1,174 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//ErrOptedOut means the SSO accepted the notification but sent it nowhere,
+//because the user allows none of the channels for it
+var ErrOptedOut = errors.New("user opted out of every channel for this notification")
+
+//Channel is how a notification reaches the user, the SENT_METHOD values of common
+type Channel int
+
+const (
+	ChannelNone      Channel = common.NOT_SENT
+	ChannelEmail     Channel = common.EMAIL
+	ChannelSMS       Channel = common.SMS_MESSAGE
+	ChannelPhoneCall Channel = common.PHONE_CALL
+)
+
+func (c Channel) String() string {
+	switch c {
+	case ChannelNone:
+		return "none"
+	case ChannelEmail:
+		return "email"
+	case ChannelSMS:
+		return "sms"
+	case ChannelPhoneCall:
+		return "phone_call"
+	}
+	return "Channel(" + strconv.Itoa(int(c)) + ")"
+}
+
+//Channels is a set of Channel in order of preference
+type Channels []Channel
+
+func (c Channels) Has(v Channel) bool {
+	for _, have := range c {
+		if have == v {
+			return true
+		}
+	}
+	return false
+}
+
+//Add returns c with v appended unless it is in c already
+func (c Channels) Add(v ...Channel) Channels {
+	ret := append(Channels(nil), c...)
+	for _, x := range v {
+		if !ret.Has(x) {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+//Notification is a message to the user behind a token
+type Notification struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	//Sales notifications need ScopeContactSales and the user's consent to sales contact
+	IsSales bool `json:"is_sales,omitempty"`
+	//The SSO takes the first one as preferred_send_methods and falls back on its own,
+	//empty leaves the choice to the SSO
+	Preferred Channels `json:"preferred,omitempty"`
+	//Optional settings of the recipient, e.g. OAuthUserInfo.Settings.
+	//With them the send is skipped if the user allows no channel, see AllowedChannels.
+	Settings *user.UserSettingEntity `json:"settings,omitempty"`
+}
+
+func (n *Notification) Validate() error {
+	if n.Title == "" || n.Content == "" {
+		return common.ParamsError
+	}
+	return nil
+}
+
+//RequiredScopes is what the token must grant to send n
+func (n *Notification) RequiredScopes() Scopes {
+	if n.IsSales {
+		return Scopes{ScopeNotifications, ScopeContactSales}
+	}
+	return Scopes{ScopeNotifications}
+}
+
+//SendNotificationWithToken sends n to the user of Token and returns the channel the SSO used.
+//
+//A user that allows no channel for n gives an *OptedOutError matching ErrOptedOut,
+//without a network call if n.Settings tell so already.
+//A token known to lack a scope gives ErrInsufficientScope without a network call.
+//Rejections of the SSO are *common.APIError, everything else is a transport failure.
+func (o *OAuth) SendNotificationWithToken(ctx context.Context, Token *OAuthToken, n Notification) (Channel, error) {
+	return o.sendNotification(ctx, copyToken(Token), n)
+}
+
+//SendNotificationContext is SendNotificationWithToken with o.Token
+//
+//Deprecated: o.Token is shared by everything using o, use SendNotificationWithToken or Session.SendNotification
+func (o *OAuth) SendNotificationContext(ctx context.Context, n Notification) (Channel, error) {
+	return o.sendNotification(ctx, o.Token, n)
+}
+
+func (o *OAuth) sendNotification(ctx context.Context, t *OAuthToken, n Notification) (Channel, error) {
+	if t == nil || t.AccessToken == "" {
+		return ChannelNone, common.ParamsError
+	}
+	if err := n.Validate(); err != nil {
+		return ChannelNone, err
+	}
+	if err := requireScope(t, n.RequiredScopes()...); err != nil {
+		return ChannelNone, err
+	}
+	preferred := n.Preferred
+	if n.Settings != nil {
+		if preferred = AllowedChannels(*n.Settings, n.IsSales, n.Preferred); len(preferred) == 0 {
+			return ChannelNone, &OptedOutError{
+				IsSales:    n.IsSales,
+				ClientSide: true,
+			}
+		}
+	}
+
+	var params = map[string]string{}
+	params["access_token"] = t.AccessToken
+	params["title"] = n.Title
+	params["content"] = n.Content
+	if n.IsSales {
+		params["is_sales"] = "1"
+	} else {
+		params["is_sales"] = "0"
+	}
+	if len(preferred) > 0 {
+		params["preferred_send_methods"] = strconv.Itoa(int(preferred[0]))
+	}
+
+	res, status, err := o.API.PostURLContext(ctx, "/oauth_ability/notifications", params)
+	if err != nil {
+		return ChannelNone, err
+	}
+	if status != http.StatusCreated {
+		return ChannelNone, common.StatusError(status, res)
+	}
+	var ret common.SENT_METHOD
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return ChannelNone, err
+	}
+	if Channel(ret.IotaNum) == ChannelNone {
+		return ChannelNone, &OptedOutError{
+			IsSales: n.IsSales,
+		}
+	}
+	return Channel(ret.IotaNum), nil
+}
+
+//Deprecated: o.Token is shared by everything using o, use SendNotificationWithToken or Session.SendNotification
+func (o *OAuth) SendNotification(n Notification) (Channel, error) {
+	return o.SendNotificationContext(o.API.Context(), n)
+}
+
+//SendNotification is OAuth.SendNotificationWithToken with the token of the session
+func (s *Session) SendNotification(ctx context.Context, n Notification) (Channel, error) {
+	t := s.Token()
+	if t == nil {
+		return ChannelNone, ErrReauthorizationRequired
+	}
+	return s.OAuth.sendNotification(ctx, t, n)
+}
@@ -0,0 +1,27 @@
+package oauth_test
+
+import (
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+func TestSendNotificationWithToken(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	token, err := o.NewSession().Exchange(ctx, srv.IssueAuthCode("app", maskID(1), []string{string(oauth.ScopeNotifications)}, "", ""), "")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	c, err := o.SendNotificationWithToken(ctx, token, oauth.Notification{Title: "hi", Content: "there"})
+	if err != nil || c != oauth.ChannelEmail {
+		t.Fatalf("SendNotificationWithToken: %v, %v", c, err)
+	}
+	if n := srv.Notifications(); len(n) != 1 {
+		t.Fatalf("%d notifications were sent, want 1", len(n))
+	}
+	if o.Token.AccessToken != "" {
+		t.Fatal("SendNotificationWithToken changed the token of the shared OAuth")
+	}
+}
@@ -1,8 +1,12 @@
 package oauth
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"net/http"
+	"net/url"
+	"sync"
 
 	"github.com/InteractivePlus/InteractiveSSO-Go/common"
 	"github.com/InteractivePlus/InteractiveSSO-Go/user"
@@ -10,7 +14,7 @@ import (
 
 type OAuthToken struct {
 	AccessToken    string   `json:"access_token"`
-	RefreshToken   string   `json:"refresh_token, omitempty"`
+	RefreshToken   string   `json:"refresh_token,omitempty"`
 	ObtainedMethod int      `json:"obtained_method"`
 	Issued         int      `json:"issued"`
 	Expires        int      `json:"expires"`
@@ -21,6 +25,7 @@ type OAuthToken struct {
 	Scope          []string `json:"scope"`
 }
 
+//OAuthScope describes the scopes by their json tags, see Scope for the typed model
 type OAuthScope struct {
 	Info          string `json:"info"`
 	Notifications string `json:"notifications"`
@@ -33,176 +38,358 @@ type OAuthUserInfo struct {
 	Settings    user.UserSettingEntity `json:"settings"`
 }
 
+//OAuth is a client of the SSO, created with NewClient. Without a configuration,
+//Token.ClientID identifies the client.
+//
+//The configuration is the only state an OAuth shares between calls, so one OAuth
+//serves any number of goroutines, like the one of api.API does. The state of each
+//user goes into a Session, or a RefreshingTokenSource once the user is authorized.
+//
+//Token, AuthCode, Scope and UserInfo are the single-user state of older versions.
+//The methods that change them in place, GetAccessToken, RefreshAccessToken,
+//LoadToken and ForgetToken, must not be called on a shared OAuth.
 type OAuth struct {
-	API      *api.API
+	API      common.Transport
 	Token    *OAuthToken
 	Scope    *OAuthScope
 	UserInfo *OAuthUserInfo
 	AuthCode string
+
+	mu     sync.RWMutex
+	config *ClientConfig
+}
+
+//saveToken writes t through to the Store of the client. The token is still returned to the caller
+//if that fails, so the error of a successful call may come from the store alone.
+func (o *OAuth) saveToken(t *OAuthToken) error {
+	store := o.client().Store
+	if store == nil {
+		return nil
+	}
+	return store.Save(common.OAuthTokenKey(t.ClientID, t.MaskID), t)
 }
 
-//Optional Params: code_challenge code_challenge_type	state
-//func (o *OAuth) GetAuthCode(UID, access_token, mask_id, client_id, scope, redirect_uri string, opts ...string) (string, error) {
+//StoredToken returns the token the Store of the client holds for MaskID, common.ErrTokenNotFound if there is none
+func (o *OAuth) StoredToken(MaskID string) (*OAuthToken, error) {
+	c := o.client()
+	if c.Store == nil || c.ClientID == "" {
+		return nil, common.ParamsError
+	}
+	var t OAuthToken
+	if err := c.Store.Load(common.OAuthTokenKey(c.ClientID, MaskID), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+//DeleteToken deletes t from the Store of the client.
+//The SSO has no revocation endpoint, the token stays valid until it expires.
+func (o *OAuth) DeleteToken(t *OAuthToken) error {
+	store := o.client().Store
+	if store == nil || t == nil || t.MaskID == "" {
+		return nil
+	}
+	return store.Delete(common.OAuthTokenKey(t.ClientID, t.MaskID))
+}
+
+//LoadToken replaces o.Token with the one stored for MaskID, common.ErrTokenNotFound if there is none
 //
-//}
+//Deprecated: it changes o.Token, use StoredToken
+func (o *OAuth) LoadToken(MaskID string) (*OAuthToken, error) {
+	t, err := o.StoredToken(MaskID)
+	if err != nil {
+		return nil, err
+	}
+	o.Token = t
+	return t, nil
+}
 
-//Optional Params: client_secret code_verifier
-func (o *OAuth) GetAccessToken(isPKCE bool, clientSecret string, opts ...string) (*OAuthToken, *common.JSONError, error) {
-	if o.AuthCode == "" || o.Token.ClientID == "" {
-		return nil, nil, common.ParamsError
+//ForgetToken deletes o.Token from the Store of the client and keeps only its ClientID in o.Token.
+//
+//Deprecated: it changes o.Token, use DeleteToken or Session.Forget
+func (o *OAuth) ForgetToken() error {
+	if o.Token == nil {
+		return nil
+	}
+	err := o.DeleteToken(o.Token)
+	o.Token = &OAuthToken{
+		ClientID: o.Token.ClientID,
 	}
+	return err
+}
 
-	var payload = map[string]string{}
-	payload["code"] = o.AuthCode
-	payload["client_id"] = o.Token.ClientID
+//exchange trades AuthCode for a token, with CodeVerifier if it is set and the client secret otherwise.
+//An empty ClientSecret is taken from the configuration, unless the client uses PKCE.
+func (o *OAuth) exchange(ctx context.Context, AuthCode, ClientSecret, CodeVerifier string) (*OAuthToken, error) {
+	c := o.client()
+	if AuthCode == "" || c.ClientID == "" {
+		return nil, common.ParamsError
+	}
 
-	if !isPKCE {
-		payload["client_secret"] = clientSecret
+	var payload = map[string]string{}
+	payload["code"] = AuthCode
+	payload["client_id"] = c.ClientID
+
+	if CodeVerifier == "" {
+		if ClientSecret == "" {
+			if c.UsesPKCE() {
+				return nil, ErrMissingCodeVerifier
+			}
+			ClientSecret = c.ClientSecret
+		}
+		payload["client_secret"] = ClientSecret
 	} else {
 		//PKCE Mode	Ignore ClientSecret
-		codeVerifier := opts[0]
-		payload["code_verifier"] = codeVerifier
+		if err := ValidateCodeVerifier(CodeVerifier); err != nil {
+			return nil, err
+		}
+		payload["code_verifier"] = CodeVerifier
 	}
 
-	res, status, err := o.API.PostURL("/oauth_token", payload)
+	res, status, err := o.API.PostURLContext(ctx, "/oauth_token", payload)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if status != common.HTTP201CREATED {
-		return nil, nil, common.AuthError
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 	var ret OAuthToken
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
+	return &ret, o.saveToken(&ret)
+}
 
-	o.Token = &ret
-	return &ret, nil, nil
+//Optional Params: client_secret code_verifier
+//The PKCE mode needs code_verifier. An empty clientSecret is taken from the configuration of o.
+//
+//Deprecated: it reads o.AuthCode and replaces o.Token, use Session.Exchange
+func (o *OAuth) GetAccessTokenContext(ctx context.Context, isPKCE bool, clientSecret string, opts ...string) (*OAuthToken, error) {
+	var codeVerifier string
+	if isPKCE {
+		if len(opts) > 0 {
+			codeVerifier = opts[0]
+		}
+		if codeVerifier == "" {
+			return nil, ErrMissingCodeVerifier
+		}
+	} else if clientSecret == "" {
+		//The configuration may ask for PKCE, but this call asked for the secret
+		clientSecret = o.client().ClientSecret
+	}
+	ret, err := o.exchange(ctx, o.AuthCode, clientSecret, codeVerifier)
+	if ret != nil {
+		o.Token = ret
+	}
+	return ret, err
 
 }
 
-//Optional Params: client_secret mask_id
-func (o *OAuth) VerifyAccessToken(opts ...string) (*OAuthToken, *common.JSONError, error) {
-	if o.Token == nil || o.Token.ClientID == "" {
-		return nil, nil, common.ParamsError
+//Deprecated: it reads o.AuthCode and replaces o.Token, use Session.Exchange
+func (o *OAuth) GetAccessTokenE(isPKCE bool, clientSecret string, opts ...string) (*OAuthToken, error) {
+	return o.GetAccessTokenContext(o.API.Context(), isPKCE, clientSecret, opts...)
+}
+
+//Deprecated: use Session.Exchange
+func (o *OAuth) GetAccessToken(isPKCE bool, clientSecret string, opts ...string) (*OAuthToken, *common.JSONError, error) {
+	ret, err := o.GetAccessTokenE(isPKCE, clientSecret, opts...)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+//verify asks the SSO about AccessToken, see VerifyAccessTokenContext for opts
+func (o *OAuth) verify(ctx context.Context, AccessToken string, opts ...string) (*OAuthToken, error) {
+	c := o.client()
+	if c.ClientID == "" {
+		return nil, common.ParamsError
 	}
 	var params = map[string]string{}
-	params["access_token"] = o.Token.AccessToken
-	params["client_id"] = o.Token.ClientID
+	params["access_token"] = AccessToken
+	params["client_id"] = c.ClientID
 	if len(opts) == 1 {
 		params["client_secret"] = opts[0]
 	} else if len(opts) > 1 {
 		params["client_secret"] = opts[0]
 		params["mask_id"] = opts[1]
+	} else if c.ClientSecret != "" {
+		params["client_secret"] = c.ClientSecret
 	}
-	res, status, err := o.API.GetURLWithParams("/oauth_token/verified_status", params)
+	res, status, err := o.API.GetURLWithParamsContext(ctx, "/oauth_token/verified_status", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP200OK {
-		return nil, nil, common.AuthError
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret OAuthToken
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-//Optional Params: client_secret
-func (o *OAuth) RefreshAccessToken(opts ...string) (*OAuthToken, *common.JSONError, error) {
-	if o.Token == nil || o.Token.ClientID == "" {
-		return nil, nil, common.ParamsError
+//Optional Params: client_secret mask_id
+//Without client_secret the one of the configuration of o is sent, if any.
+//See VerifyCache for checking tokens presented by other clients.
+func (o *OAuth) VerifyAccessTokenContext(ctx context.Context, opts ...string) (*OAuthToken, error) {
+	if o.Token == nil {
+		return nil, common.ParamsError
+	}
+	return o.verify(ctx, o.Token.AccessToken, opts...)
+}
+
+func (o *OAuth) VerifyAccessTokenE(opts ...string) (*OAuthToken, error) {
+	return o.VerifyAccessTokenContext(o.API.Context(), opts...)
+}
+
+//Deprecated: use VerifyAccessTokenE or VerifyAccessTokenContext
+func (o *OAuth) VerifyAccessToken(opts ...string) (*OAuthToken, *common.JSONError, error) {
+	ret, err := o.VerifyAccessTokenE(opts...)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+//refresh trades the refresh token of t for a new token, see RefreshAccessTokenContext for opts
+func (o *OAuth) refresh(ctx context.Context, t *OAuthToken, opts ...string) (*OAuthToken, error) {
+	c := o.client()
+	if t == nil || c.ClientID == "" {
+		return nil, common.ParamsError
 	}
 	var params = map[string]string{}
-	params["client_id"] = o.Token.ClientID
-	if o.Token.RefreshToken != "" {
-		params["refresh_token"] = o.Token.RefreshToken
+	params["client_id"] = c.ClientID
+	if t.RefreshToken != "" {
+		params["refresh_token"] = t.RefreshToken
 	}
 
 	if len(opts) > 0 {
 		params["client_secret"] = opts[0]
+	} else if c.ClientSecret != "" {
+		params["client_secret"] = c.ClientSecret
 	}
 
-	res, status, err := o.API.GetURLWithParams("/oauth_token/refresh_result", params)
+	res, status, err := o.API.GetURLWithParamsContext(ctx, "/oauth_token/refresh_result", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret OAuthToken
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
+	}
+
+	//Not every response repeats the refresh token
+	if ret.RefreshToken == "" {
+		ret.RefreshToken = t.RefreshToken
 	}
+	return &ret, o.saveToken(&ret)
+}
 
-	return &ret, nil, nil
+//Optional Params: client_secret
+//Without client_secret the one of the configuration of o is sent, if any.
+//The refreshed token replaces o.Token
+//
+//Deprecated: it replaces o.Token, use Session.Refresh or a RefreshingTokenSource
+func (o *OAuth) RefreshAccessTokenContext(ctx context.Context, opts ...string) (*OAuthToken, error) {
+	ret, err := o.refresh(ctx, o.Token, opts...)
+	if ret != nil {
+		o.Token = ret
+	}
+	return ret, err
 
 }
 
-func (o *OAuth) GetUserInfo() (*OAuthUserInfo, *common.JSONError, error) {
-	if o.Token == nil {
-		return nil, nil, common.ParamsError
+//Deprecated: it replaces o.Token, use Session.Refresh or a RefreshingTokenSource
+func (o *OAuth) RefreshAccessTokenE(opts ...string) (*OAuthToken, error) {
+	return o.RefreshAccessTokenContext(o.API.Context(), opts...)
+}
+
+//Deprecated: use Session.Refresh or a RefreshingTokenSource
+func (o *OAuth) RefreshAccessToken(opts ...string) (*OAuthToken, *common.JSONError, error) {
+	ret, err := o.RefreshAccessTokenE(opts...)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+//userInfo fetches the user info t grants access to
+func (o *OAuth) userInfo(ctx context.Context, t *OAuthToken) (*OAuthUserInfo, error) {
+	if t == nil {
+		return nil, common.ParamsError
+	}
+	if err := requireScope(t, ScopeInfo); err != nil {
+		return nil, err
 	}
 	//参数过少不建议调用GetURLWithParams，因为会有额外开销
-	res, status, err := o.API.GetURL(fmt.Sprintf("/oauth_ability/user_info?access_token=%s", o.Token.AccessToken))
+	res, status, err := o.API.GetURLContext(ctx, fmt.Sprintf("/oauth_ability/user_info?access_token=%s", url.QueryEscape(t.AccessToken)))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret OAuthUserInfo
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 
 }
 
-func (o *OAuth) GetNotifications(Title, Content string, IsSales bool, Preferred_send_methods int) (int, *common.JSONError, error) {
-	if o.Token == nil {
-		return 0, nil, common.ParamsError
-	}
-
-	var params = map[string]string{}
-	params["access_token"] = o.Token.AccessToken
-	params["title"] = Title
-	params["content"] = Content
+//Fails with ErrInsufficientScope without a network call if o.Token is known to lack ScopeInfo
+func (o *OAuth) GetUserInfoContext(ctx context.Context) (*OAuthUserInfo, error) {
+	return o.userInfo(ctx, o.Token)
+}
 
-	if IsSales {
-		params["is_sales"] = "1"
-	} else {
-		params["is_sales"] = "0"
-	}
+func (o *OAuth) GetUserInfoE() (*OAuthUserInfo, error) {
+	return o.GetUserInfoContext(o.API.Context())
+}
 
-	params["preferred_send_methods"] = strconv.Itoa(Preferred_send_methods)
+//Deprecated: use GetUserInfoE or GetUserInfoContext
+func (o *OAuth) GetUserInfo() (*OAuthUserInfo, *common.JSONError, error) {
+	ret, err := o.GetUserInfoE()
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
 
-	res, status, err := o.API.PostURL("/oauth_token/refresh_result", params)
-	if err != nil {
-		return 0, nil, err
+//Returns common.NOT_SENT without error if the user opted out
+//
+//Deprecated: use SendNotificationWithToken
+func (o *OAuth) GetNotificationsContext(ctx context.Context, Title, Content string, IsSales bool, Preferred_send_methods int) (int, error) {
+	n := Notification{
+		Title:   Title,
+		Content: Content,
+		IsSales: IsSales,
 	}
-
-	if status != common.HTTP201CREATED {
-		return 0, nil, err
+	if Preferred_send_methods != common.NOT_SENT {
+		n.Preferred = Channels{Channel(Preferred_send_methods)}
 	}
-	var ret common.SENT_METHOD
-
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return 0, err, nil
+	c, err := o.sendNotification(ctx, o.Token, n)
+	if errors.Is(err, ErrOptedOut) {
+		return common.NOT_SENT, nil
 	}
+	return int(c), err
+}
 
-	return ret.IotaNum, nil, nil
+//Deprecated: use SendNotificationWithToken
+func (o *OAuth) GetNotificationsE(Title, Content string, IsSales bool, Preferred_send_methods int) (int, error) {
+	return o.GetNotificationsContext(o.API.Context(), Title, Content, IsSales, Preferred_send_methods)
+}
 
+//Deprecated: use SendNotificationWithToken
+func (o *OAuth) GetNotifications(Title, Content string, IsSales bool, Preferred_send_methods int) (int, *common.JSONError, error) {
+	ret, err := o.GetNotificationsE(Title, Content, IsSales, Preferred_send_methods)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
 }
@@ -0,0 +1,86 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+)
+
+//code_challenge_type values, see RFC 7636
+const (
+	ChallengeS256  = "S256"
+	ChallengePlain = "plain"
+)
+
+var (
+	ErrMissingCodeVerifier = errors.New("PKCE code_verifier missing")
+	ErrInvalidCodeVerifier = errors.New("PKCE code_verifier must be 43-128 characters of [A-Za-z0-9-._~]")
+)
+
+//PKCE holds the secret half of a Proof Key for Code Exchange.
+//The challenge goes into the AuthorizeRequest, the verifier into the code exchange, see Session.
+type PKCE struct {
+	Verifier      string
+	ChallengeType string
+}
+
+//NewPKCE creates a random 43 character verifier using crypto/rand.
+//ChallengeType is ChallengeS256 or ChallengePlain, S256 should be used whenever possible.
+func NewPKCE(ChallengeType string) (*PKCE, error) {
+	if ChallengeType != ChallengeS256 && ChallengeType != ChallengePlain {
+		return nil, ErrInvalidCodeChallenge
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &PKCE{
+		Verifier:      base64.RawURLEncoding.EncodeToString(b),
+		ChallengeType: ChallengeType,
+	}, nil
+}
+
+func (p *PKCE) Challenge() string {
+	return CodeChallenge(p.ChallengeType, p.Verifier)
+}
+
+//Apply puts the challenge into r
+func (p *PKCE) Apply(r *AuthorizeRequest) {
+	r.CodeChallenge = p.Challenge()
+	r.CodeChallengeType = p.ChallengeType
+}
+
+//CodeChallenge derives the code_challenge of Verifier
+func CodeChallenge(ChallengeType, Verifier string) string {
+	if ChallengeType == ChallengeS256 {
+		sum := sha256.Sum256([]byte(Verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return Verifier
+}
+
+//ValidateCodeVerifier checks length and charset of a verifier
+func ValidateCodeVerifier(Verifier string) error {
+	if len(Verifier) < 43 || len(Verifier) > 128 {
+		return ErrInvalidCodeVerifier
+	}
+	for _, c := range Verifier {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+		default:
+			return ErrInvalidCodeVerifier
+		}
+	}
+	return nil
+}
+
+//VerifyCodeChallenge is the server side check of a verifier against the stored challenge
+func VerifyCodeChallenge(ChallengeType, Challenge, Verifier string) bool {
+	if ChallengeType != ChallengeS256 && ChallengeType != ChallengePlain {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(CodeChallenge(ChallengeType, Verifier)), []byte(Challenge)) == 1
+}
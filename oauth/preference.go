@@ -0,0 +1,59 @@
+package oauth
+
+import (
+	"fmt"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//DefaultChannelOrder is the order the SSO falls back in after the preferred channel
+var DefaultChannelOrder = Channels{ChannelEmail, ChannelSMS, ChannelPhoneCall}
+
+//OptedOutError tells that a notification went nowhere because of the user's settings.
+//It matches ErrOptedOut with errors.Is.
+type OptedOutError struct {
+	IsSales bool
+	//True if the settings were checked before sending and nothing was sent to the SSO
+	ClientSide bool
+}
+
+func (e *OptedOutError) Error() string {
+	kind := "notifications"
+	if e.IsSales {
+		kind = "sales notifications"
+	}
+	if e.ClientSide {
+		return fmt.Sprintf("user allows no channel for %s (checked before sending)", kind)
+	}
+	return fmt.Sprintf("user allows no channel for %s", kind)
+}
+
+func (e *OptedOutError) Is(target error) bool {
+	return target == ErrOptedOut
+}
+
+//ChannelAllowed tells whether s lets a notification through c.
+//Sales notifications need both the channel and its sales variant.
+func ChannelAllowed(s user.UserSettingEntity, c Channel, IsSales bool) bool {
+	switch c {
+	case ChannelEmail:
+		return s.AllowEmailNotifications && (!IsSales || s.AllowSaleEmail)
+	case ChannelSMS:
+		return s.AllowSMSNotifications && (!IsSales || s.AllowSaleSMS)
+	case ChannelPhoneCall:
+		return s.AllowCallNotifications && (!IsSales || s.AllowSaleCall)
+	}
+	return false
+}
+
+//AllowedChannels returns the channels s allows, Preferred ones first and the rest in DefaultChannelOrder.
+//Empty means the user opted out. Whether the user has an email address or phone number is up to the SSO.
+func AllowedChannels(s user.UserSettingEntity, IsSales bool, Preferred Channels) Channels {
+	var ret Channels
+	for _, c := range Preferred.Add(DefaultChannelOrder...) {
+		if ChannelAllowed(s, c, IsSales) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+package oauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Scope is one permission a user grants to a client
+type Scope string
+
+//Scopes known to the SSO, the json tags of OAuthScope
+const (
+	ScopeInfo          Scope = "info"
+	ScopeNotifications Scope = "notifications"
+	ScopeContactSales  Scope = "contact_sales"
+)
+
+//Scopes is a set of Scope, kept in order of appearance without duplicates
+type Scopes []Scope
+
+//ParseScopes reads the space separated wire format, e.g. of the scope query parameter
+func ParseScopes(s string) Scopes {
+	var ret Scopes
+	for _, v := range strings.Fields(s) {
+		ret = ret.Add(Scope(v))
+	}
+	return ret
+}
+
+//ScopesOf converts the []string of OAuthToken.Scope
+func ScopesOf(s []string) Scopes {
+	var ret Scopes
+	for _, v := range s {
+		ret = ret.Add(Scope(v))
+	}
+	return ret
+}
+
+//String gives the space separated wire format
+func (s Scopes) String() string {
+	return strings.Join(s.Strings(), " ")
+}
+
+func (s Scopes) Strings() []string {
+	ret := make([]string, len(s))
+	for i, v := range s {
+		ret[i] = string(v)
+	}
+	return ret
+}
+
+func (s Scopes) Has(v Scope) bool {
+	for _, have := range s {
+		if have == v {
+			return true
+		}
+	}
+	return false
+}
+
+//HasAll is true for an empty want
+func (s Scopes) HasAll(want ...Scope) bool {
+	for _, v := range want {
+		if !s.Has(v) {
+			return false
+		}
+	}
+	return true
+}
+
+//Add returns s with v appended unless it is in s already
+func (s Scopes) Add(v ...Scope) Scopes {
+	ret := append(Scopes(nil), s...)
+	for _, x := range v {
+		if !ret.Has(x) {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+func (s Scopes) Union(o Scopes) Scopes {
+	return s.Add(o...)
+}
+
+func (s Scopes) Intersect(o Scopes) Scopes {
+	var ret Scopes
+	for _, v := range s {
+		if o.Has(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+//Minus returns what of s is not in o
+func (s Scopes) Minus(o Scopes) Scopes {
+	var ret Scopes
+	for _, v := range s {
+		if !o.Has(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func (t *OAuthToken) Scopes() Scopes {
+	return ScopesOf(t.Scope)
+}
+
+func (t *OAuthToken) HasScope(s ...Scope) bool {
+	return t.Scopes().HasAll(s...)
+}
+
+//requireScope fails with ErrInsufficientScope if t is known to lack a scope of want.
+//A token without Scope, e.g. one built from a bare access token, is left to the SSO to judge.
+func requireScope(t *OAuthToken, want ...Scope) error {
+	if len(t.Scope) == 0 {
+		return nil
+	}
+	if missing := Scopes(want).Minus(t.Scopes()); len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrInsufficientScope, missing)
+	}
+	return nil
+}
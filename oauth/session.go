@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"context"
+	"sync"
+)
+
+//SessionState is the per-user part of an authorization, e.g. to keep it in a server side session between requests
+type SessionState struct {
+	//Verifier of the PKCE started for the next exchange
+	CodeVerifier  string      `json:"code_verifier,omitempty"`
+	ChallengeType string      `json:"challenge_type,omitempty"`
+	Token         *OAuthToken `json:"token,omitempty"`
+}
+
+//Session holds the authorization of one user against a shared OAuth, which it never changes.
+//This is how an OAuth that serves many users, like the one of api.API, runs a flow.
+//All methods are safe for concurrent use, calls reaching the SSO are serialized per Session
+//so that a token is never exchanged or refreshed twice.
+type Session struct {
+	OAuth *OAuth
+
+	mu    sync.Mutex
+	pkce  *PKCE
+	token *OAuthToken
+}
+
+func (o *OAuth) NewSession() *Session {
+	return &Session{
+		OAuth: o,
+	}
+}
+
+//ResumeSession continues a session saved with State
+func (o *OAuth) ResumeSession(st SessionState) *Session {
+	s := o.NewSession()
+	if st.CodeVerifier != "" {
+		s.pkce = &PKCE{
+			Verifier:      st.CodeVerifier,
+			ChallengeType: st.ChallengeType,
+		}
+	}
+	s.token = copyToken(st.Token)
+	return s
+}
+
+func (s *Session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SessionState{
+		Token: copyToken(s.token),
+	}
+	if s.pkce != nil {
+		st.CodeVerifier = s.pkce.Verifier
+		st.ChallengeType = s.pkce.ChallengeType
+	}
+	return st
+}
+
+//Token is nil before the first exchange
+func (s *Session) Token() *OAuthToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyToken(s.token)
+}
+
+//StartPKCE creates a PKCE for the next authorization of the session
+func (s *Session) StartPKCE(ChallengeType string) (*PKCE, error) {
+	p, err := NewPKCE(ChallengeType)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pkce = p
+	return p, nil
+}
+
+//AuthorizeURL is OAuth.AuthorizeURL with the PKCE of the session.
+//A client using PKCE, see ClientConfig.UsesPKCE, gets one started if there is none yet.
+func (s *Session) AuthorizeURL(r AuthorizeRequest) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.CodeChallenge == "" {
+		if s.pkce == nil && s.OAuth.client().UsesPKCE() {
+			p, err := NewPKCE(ChallengeS256)
+			if err != nil {
+				return "", err
+			}
+			s.pkce = p
+		}
+		if s.pkce != nil {
+			s.pkce.Apply(&r)
+		}
+	}
+	return s.OAuth.AuthorizeURL(r)
+}
+
+//Exchange trades AuthCode for a token, with the PKCE of the session if one was started
+//and ClientSecret otherwise. An empty ClientSecret is taken from the configuration.
+func (s *Session) Exchange(ctx context.Context, AuthCode, ClientSecret string) (*OAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var verifier string
+	if s.pkce != nil {
+		verifier = s.pkce.Verifier
+	}
+	t, err := s.OAuth.exchange(ctx, AuthCode, ClientSecret, verifier)
+	if t != nil {
+		s.token = t
+		//A verifier is good for one exchange only
+		s.pkce = nil
+	}
+	return copyToken(t), err
+}
+
+//Optional Params: client_secret
+func (s *Session) Refresh(ctx context.Context, opts ...string) (*OAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil {
+		return nil, ErrReauthorizationRequired
+	}
+	t, err := s.OAuth.refresh(ctx, s.token, opts...)
+	if t != nil {
+		s.token = t
+	}
+	return copyToken(t), err
+}
+
+func (s *Session) UserInfo(ctx context.Context) (*OAuthUserInfo, error) {
+	t := s.Token()
+	if t == nil {
+		return nil, ErrReauthorizationRequired
+	}
+	return s.OAuth.userInfo(ctx, t)
+}
+
+//Forget drops the token of the session and deletes it from the store
+func (s *Session) Forget() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil {
+		return nil
+	}
+	err := s.OAuth.DeleteToken(s.token)
+	s.token = nil
+	return err
+}
+
+//TokenSource starts a RefreshingTokenSource from the current token of the session.
+//The source refreshes on its own, the session doesn't see those tokens.
+func (s *Session) TokenSource(ClientSecret string) *RefreshingTokenSource {
+	return NewTokenSource(s.OAuth, s.Token(), ClientSecret)
+}
@@ -0,0 +1,284 @@
+package oauth_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+const (
+	users       = 8
+	redirectURI = "https://app.example/callback"
+)
+
+//setup seeds users with one mask each for the client "app" and returns the OAuth of that client
+func setup(t *testing.T, c oauth.ClientConfig) (*ssotest.Server, *oauth.OAuth) {
+	t.Helper()
+	srv := ssotest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddClient("app", "s3cret")
+	for i := 1; i <= users; i++ {
+		srv.AddUser(user.UserEntity{
+			UID:      i,
+			Username: fmt.Sprintf("user%d", i),
+			Email:    fmt.Sprintf("user%d@example.com", i),
+		}, "secret")
+		srv.AddMask(user.MaskIDEntity{
+			MaskId:   maskID(i),
+			ClientID: "app",
+			UID:      i,
+			Settings: user.UserSettingEntity{AllowEmailNotifications: true},
+		})
+	}
+	c.ClientID = "app"
+	c.RedirectURIs = []string{redirectURI}
+	c.Store = tokenstore.NewMemory()
+	return srv, oauth.NewClient(srv.API(), c)
+}
+
+func maskID(i int) string {
+	return fmt.Sprintf("m%d", i)
+}
+
+//consent follows target to the consent page of srv as the owner of MaskID and returns the code
+func consent(srv *ssotest.Server, target, MaskID string) (string, error) {
+	back, err := consentRedirect(srv, target, MaskID)
+	if err != nil {
+		return "", err
+	}
+	code := back.Query().Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no code in %s", back)
+	}
+	return code, nil
+}
+
+//consentRedirect is consent returning where the consent page redirects back to
+func consentRedirect(srv *ssotest.Server, target, MaskID string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("mask_id", MaskID)
+	u.RawQuery = q.Encode()
+
+	client := *srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Location()
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{
+		ClientSecret: "s3cret",
+		PKCE:         true,
+		Scope:        oauth.Scopes{oauth.ScopeInfo, oauth.ScopeNotifications},
+	})
+	ctx := srv.API().Context()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	//Rotating the configuration must not disturb the flows
+	go func() {
+		c := o.Config()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := o.Configure(c); err != nil {
+				t.Errorf("Configure: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 1; i <= users; i++ {
+		wg.Add(1)
+		go func(MaskID string) {
+			defer wg.Done()
+			s := o.NewSession()
+			target, err := s.AuthorizeURL(oauth.AuthorizeRequest{RedirectURI: redirectURI})
+			if err != nil {
+				t.Errorf("%s: AuthorizeURL: %v", MaskID, err)
+				return
+			}
+			code, err := consent(srv, target, MaskID)
+			if err != nil {
+				t.Errorf("%s: consent: %v", MaskID, err)
+				return
+			}
+			//A PKCE client must not fall back to the secret
+			token, err := s.Exchange(ctx, code, "")
+			if err != nil {
+				t.Errorf("%s: Exchange: %v", MaskID, err)
+				return
+			}
+			if token.MaskID != MaskID {
+				t.Errorf("%s: got the token of %s", MaskID, token.MaskID)
+				return
+			}
+			info, err := s.UserInfo(ctx)
+			if err != nil || info.MaskID != MaskID {
+				t.Errorf("%s: UserInfo: %+v, %v", MaskID, info, err)
+				return
+			}
+			refreshed, err := s.Refresh(ctx)
+			if err != nil || refreshed.AccessToken == token.AccessToken {
+				t.Errorf("%s: Refresh: %+v, %v", MaskID, refreshed, err)
+				return
+			}
+			if c, err := s.SendNotification(ctx, oauth.Notification{Title: "hi", Content: MaskID}); err != nil || c != oauth.ChannelEmail {
+				t.Errorf("%s: SendNotification: %v, %v", MaskID, c, err)
+				return
+			}
+			stored, err := o.StoredToken(MaskID)
+			if err != nil || stored.AccessToken != refreshed.AccessToken {
+				t.Errorf("%s: StoredToken: %+v, %v", MaskID, stored, err)
+				return
+			}
+			if err := s.Forget(); err != nil {
+				t.Errorf("%s: Forget: %v", MaskID, err)
+				return
+			}
+			if _, err := o.StoredToken(MaskID); !errors.Is(err, common.ErrTokenNotFound) {
+				t.Errorf("%s: StoredToken after Forget: %v", MaskID, err)
+			}
+		}(maskID(i))
+	}
+	wg.Wait()
+	close(done)
+
+	if n := len(srv.Notifications()); n != users {
+		t.Fatalf("%d notifications were sent, want %d", n, users)
+	}
+	if o.Token.AccessToken != "" {
+		t.Fatal("a session changed the token of the shared OAuth")
+	}
+}
+
+func TestSessionWithoutVerifierOnPKCEClient(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret", PKCE: true})
+	code := srv.IssueAuthCode("app", maskID(1), nil, "", "")
+
+	if _, err := o.NewSession().Exchange(srv.API().Context(), code, ""); !errors.Is(err, oauth.ErrMissingCodeVerifier) {
+		t.Fatalf("Exchange without a PKCE: got %v, want ErrMissingCodeVerifier", err)
+	}
+}
+
+func TestSessionPKCEWithoutSecret(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{})
+	if !o.Config().UsesPKCE() {
+		t.Fatal("a client without a secret doesn't use PKCE")
+	}
+	s := o.NewSession()
+	target, err := s.AuthorizeURL(oauth.AuthorizeRequest{RedirectURI: redirectURI})
+	if err != nil {
+		t.Fatalf("AuthorizeURL: %v", err)
+	}
+	if u, _ := url.Parse(target); u.Query().Get("code_challenge") == "" {
+		t.Fatalf("AuthorizeURL %s has no code_challenge", target)
+	}
+	code, err := consent(srv, target, maskID(1))
+	if err != nil {
+		t.Fatalf("consent: %v", err)
+	}
+	if _, err := s.Exchange(srv.API().Context(), code, ""); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	//Without a verifier there is no secret to fall back to
+	code = srv.IssueAuthCode("app", maskID(1), nil, "", "")
+	if _, err := o.NewSession().Exchange(srv.API().Context(), code, ""); !errors.Is(err, oauth.ErrMissingCodeVerifier) {
+		t.Fatalf("Exchange without a PKCE: got %v, want ErrMissingCodeVerifier", err)
+	}
+}
+
+func TestTokenSourceRefreshesOnce(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	code := srv.IssueAuthCode("app", maskID(1), nil, "", "")
+	token, err := o.NewSession().Exchange(ctx, code, "")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	expired := *token
+	expired.Expires = 1
+	ts := oauth.NewTokenSource(o, &expired, "")
+
+	//The SSO takes every refresh token only once, a second refresh would fail
+	var wg sync.WaitGroup
+	tokens := make([]*oauth.OAuthToken, 16)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t, err := ts.Token(ctx)
+			if err == nil {
+				tokens[i] = t
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, got := range tokens {
+		if got == nil {
+			t.Fatalf("Token call %d failed", i)
+		}
+		if got.AccessToken != tokens[0].AccessToken || got.AccessToken == token.AccessToken {
+			t.Fatalf("Token call %d returned %q, want one new token for all", i, got.AccessToken)
+		}
+	}
+}
+
+func TestVerifyCacheConcurrent(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	tokens := make([]*oauth.OAuthToken, users)
+	for i := range tokens {
+		code := srv.IssueAuthCode("app", maskID(i+1), nil, "", "")
+		token, err := o.NewSession().Exchange(ctx, code, "")
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		tokens[i] = token
+	}
+	cache := oauth.NewVerifyCache(o, "")
+
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		for _, token := range tokens {
+			wg.Add(1)
+			go func(want *oauth.OAuthToken) {
+				defer wg.Done()
+				got, err := cache.Verify(ctx, want.AccessToken)
+				if err != nil || got.MaskID != want.MaskID {
+					t.Errorf("Verify %s: %+v, %v", want.MaskID, got, err)
+				}
+			}(token)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Verify(ctx, "unknown"); !errors.Is(err, oauth.ErrInvalidBearerToken) {
+				t.Errorf("Verify of an unknown token: got %v, want ErrInvalidBearerToken", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
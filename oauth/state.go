@@ -0,0 +1,282 @@
+package oauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/internal/fileutil"
+)
+
+var (
+	ErrStateNotFound = errors.New("OAuth state unknown or already used")
+	ErrStateExpired  = errors.New("OAuth state expired")
+	ErrStateMismatch = errors.New("OAuth state belongs to another session")
+	ErrStateInvalid  = errors.New("OAuth state signature invalid")
+
+	errNoStateBackend = errors.New("StateManager needs a Store or a Key")
+)
+
+//StateEntry is what a state value stands for
+type StateEntry struct {
+	State string `json:"state"`
+	//Identifies the browser session the state was issued to, e.g. a session cookie value
+	SessionID string `json:"session_id"`
+	//Opaque URL to return to after the callback, validate it before redirecting there
+	ReturnTo string `json:"return_to,omitempty"`
+	//PKCE verifier of the flow, only kept by a StateStore, never put into the state itself
+	CodeVerifier string    `json:"code_verifier,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+//StateStore keeps issued states until they are used or expire
+type StateStore interface {
+	Put(e StateEntry) error
+	//Take returns and deletes the entry, ErrStateNotFound if there is none
+	Take(State string) (*StateEntry, error)
+}
+
+//StateManager issues state values and checks them exactly once in the callback.
+//
+//With a Store the state is a random value looked up in the store.
+//With a Key it is signed and carries its own session binding, expiry and ReturnTo,
+//with both the signature is checked first and the store enforces single use.
+//A Key without a Store can't tell a replayed state from a fresh one within TTL.
+type StateManager struct {
+	Store StateStore
+	Key   []byte
+	TTL   time.Duration
+	Now   func() time.Time
+}
+
+func NewStateManager(Store StateStore, Key []byte) *StateManager {
+	return &StateManager{
+		Store: Store,
+		Key:   Key,
+		TTL:   10 * time.Minute,
+		Now:   time.Now,
+	}
+}
+
+type signedState struct {
+	Nonce    string `json:"n"`
+	Session  string `json:"s"`
+	ReturnTo string `json:"r,omitempty"`
+	Expires  int64  `json:"e"`
+}
+
+func sessionHash(SessionID string) string {
+	sum := sha256.Sum256([]byte(SessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (m *StateManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Issue creates the state for e, only SessionID, ReturnTo and CodeVerifier of e are used.
+//SessionID must not be empty, a state bound to no session would be good for every one.
+func (m *StateManager) Issue(e StateEntry) (string, error) {
+	if m.Store == nil && len(m.Key) == 0 {
+		return "", errNoStateBackend
+	}
+	if e.SessionID == "" {
+		return "", common.ParamsError
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	e.Expires = m.Now().Add(m.TTL)
+	e.State = base64.RawURLEncoding.EncodeToString(nonce)
+	if len(m.Key) > 0 {
+		payload, err := json.Marshal(&signedState{
+			Nonce:    e.State,
+			Session:  sessionHash(e.SessionID),
+			ReturnTo: e.ReturnTo,
+			Expires:  e.Expires.Unix(),
+		})
+		if err != nil {
+			return "", err
+		}
+		encoded := base64.RawURLEncoding.EncodeToString(payload)
+		e.State = encoded + "." + m.sign(encoded)
+	}
+	if m.Store != nil {
+		if err := m.Store.Put(e); err != nil {
+			return "", err
+		}
+	}
+	return e.State, nil
+}
+
+//Verify checks State against the session it arrives with and consumes it
+func (m *StateManager) Verify(State, SessionID string) (*StateEntry, error) {
+	if m.Store == nil && len(m.Key) == 0 {
+		return nil, errNoStateBackend
+	}
+	if SessionID == "" {
+		return nil, ErrStateMismatch
+	}
+	want := []byte(sessionHash(SessionID))
+	var signed *signedState
+	if len(m.Key) > 0 {
+		var err error
+		if signed, err = m.verifySignature(State); err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(signed.Session), want) != 1 {
+			return nil, ErrStateMismatch
+		}
+	}
+	var e *StateEntry
+	if m.Store != nil {
+		var err error
+		if e, err = m.Store.Take(State); err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(sessionHash(e.SessionID)), want) != 1 {
+			return nil, ErrStateMismatch
+		}
+	} else {
+		e = &StateEntry{
+			State:     State,
+			SessionID: SessionID,
+			ReturnTo:  signed.ReturnTo,
+			Expires:   time.Unix(signed.Expires, 0),
+		}
+	}
+	if m.Now().After(e.Expires) {
+		return nil, ErrStateExpired
+	}
+	return e, nil
+}
+
+func (m *StateManager) verifySignature(State string) (*signedState, error) {
+	parts := strings.SplitN(State, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(m.sign(parts[0]))) {
+		return nil, ErrStateInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrStateInvalid
+	}
+	var s signedState
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, ErrStateInvalid
+	}
+	return &s, nil
+}
+
+//MemoryStateStore keeps states in a map
+type MemoryStateStore struct {
+	mu      sync.Mutex
+	entries map[string]StateEntry
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		entries: map[string]StateEntry{},
+	}
+}
+
+func (s *MemoryStateStore) Put(e StateEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purgeExpired(s.entries)
+	s.entries[e.State] = e
+	return nil
+}
+
+func (s *MemoryStateStore) Take(State string) (*StateEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[State]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	delete(s.entries, State)
+	return &e, nil
+}
+
+func purgeExpired(entries map[string]StateEntry) {
+	now := time.Now()
+	for k, v := range entries {
+		if now.After(v.Expires) {
+			delete(entries, k)
+		}
+	}
+}
+
+//FileStateStore keeps states in a JSON file so they survive a restart.
+//It is meant for a single process, the file is rewritten on every change.
+type FileStateStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]StateEntry
+}
+
+func NewFileStateStore(path string) (*FileStateStore, error) {
+	s := &FileStateStore{
+		path:    path,
+		entries: map[string]StateEntry{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &s.entries); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *FileStateStore) Put(e StateEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purgeExpired(s.entries)
+	s.entries[e.State] = e
+	return s.flush()
+}
+
+func (s *FileStateStore) Take(State string) (*StateEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[State]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	delete(s.entries, State)
+	if err := s.flush(); err != nil {
+		//Keep it usable if the deletion couldn't be persisted
+		s.entries[State] = e
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *FileStateStore) flush() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(s.path, data, 0600)
+}
@@ -0,0 +1,171 @@
+package oauth_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+)
+
+var stateKey = []byte("0123456789abcdef0123456789abcdef")
+
+//stateManagers returns a key-only, a store-only and a combined StateManager, all on one clock
+func stateManagers(now *time.Time) map[string]*oauth.StateManager {
+	managers := map[string]*oauth.StateManager{
+		"key":       oauth.NewStateManager(nil, stateKey),
+		"store":     oauth.NewStateManager(oauth.NewMemoryStateStore(), nil),
+		"key+store": oauth.NewStateManager(oauth.NewMemoryStateStore(), stateKey),
+	}
+	for _, m := range managers {
+		m.Now = func() time.Time { return *now }
+	}
+	return managers
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	now := time.Now()
+	for name, m := range stateManagers(&now) {
+		state, err := m.Issue(oauth.StateEntry{SessionID: "sess", ReturnTo: "/home"})
+		if err != nil {
+			t.Fatalf("%s: Issue: %v", name, err)
+		}
+		e, err := m.Verify(state, "sess")
+		if err != nil {
+			t.Fatalf("%s: Verify: %v", name, err)
+		}
+		if e.ReturnTo != "/home" {
+			t.Errorf("%s: ReturnTo is %q, want /home", name, e.ReturnTo)
+		}
+	}
+}
+
+func TestStateSessionMismatch(t *testing.T) {
+	now := time.Now()
+	for name, m := range stateManagers(&now) {
+		state, err := m.Issue(oauth.StateEntry{SessionID: "sess"})
+		if err != nil {
+			t.Fatalf("%s: Issue: %v", name, err)
+		}
+		if _, err := m.Verify(state, "other"); !errors.Is(err, oauth.ErrStateMismatch) {
+			t.Errorf("%s: Verify from another session: got %v, want ErrStateMismatch", name, err)
+		}
+		if _, err := m.Verify(state, ""); !errors.Is(err, oauth.ErrStateMismatch) {
+			t.Errorf("%s: Verify without a session: got %v, want ErrStateMismatch", name, err)
+		}
+	}
+}
+
+func TestStateExpires(t *testing.T) {
+	now := time.Now()
+	for name, m := range stateManagers(&now) {
+		state, err := m.Issue(oauth.StateEntry{SessionID: "sess"})
+		if err != nil {
+			t.Fatalf("%s: Issue: %v", name, err)
+		}
+		later := now.Add(m.TTL + time.Second)
+		m.Now = func() time.Time { return later }
+		if _, err := m.Verify(state, "sess"); !errors.Is(err, oauth.ErrStateExpired) {
+			t.Errorf("%s: Verify after TTL: got %v, want ErrStateExpired", name, err)
+		}
+	}
+}
+
+func TestStateSingleUse(t *testing.T) {
+	now := time.Now()
+	for name, m := range stateManagers(&now) {
+		if m.Store == nil {
+			//A Key alone can't tell a replay, see StateManager
+			continue
+		}
+		state, err := m.Issue(oauth.StateEntry{SessionID: "sess"})
+		if err != nil {
+			t.Fatalf("%s: Issue: %v", name, err)
+		}
+		if _, err := m.Verify(state, "sess"); err != nil {
+			t.Fatalf("%s: Verify: %v", name, err)
+		}
+		if _, err := m.Verify(state, "sess"); !errors.Is(err, oauth.ErrStateNotFound) {
+			t.Errorf("%s: second Verify: got %v, want ErrStateNotFound", name, err)
+		}
+	}
+}
+
+func TestStateSignature(t *testing.T) {
+	m := oauth.NewStateManager(nil, stateKey)
+	state, err := m.Issue(oauth.StateEntry{SessionID: "sess", ReturnTo: "/home"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	parts := strings.SplitN(state, ".", 2)
+	other := oauth.NewStateManager(nil, []byte("another key of at least 32 bytes"))
+	forged, err := other.Issue(oauth.StateEntry{SessionID: "sess", ReturnTo: "https://evil.example"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	tests := map[string]string{
+		"unsigned":                parts[0],
+		"truncated signature":     state[:len(state)-1],
+		"signed with another key": forged,
+		"payload swapped":         strings.SplitN(forged, ".", 2)[0] + "." + parts[1],
+	}
+	for name, s := range tests {
+		if _, err := m.Verify(s, "sess"); !errors.Is(err, oauth.ErrStateInvalid) {
+			t.Errorf("%s: got %v, want ErrStateInvalid", name, err)
+		}
+	}
+}
+
+func TestStateManagerNeedsStoreOrKey(t *testing.T) {
+	m := oauth.NewStateManager(nil, nil)
+	if _, err := m.Issue(oauth.StateEntry{SessionID: "sess"}); err == nil {
+		t.Fatal("Issue without a Store or a Key succeeded")
+	}
+	if _, err := m.Verify("state", "sess"); err == nil {
+		t.Fatal("Verify without a Store or a Key succeeded")
+	}
+	m = oauth.NewStateManager(nil, stateKey)
+	if _, err := m.Issue(oauth.StateEntry{}); !errors.Is(err, common.ParamsError) {
+		t.Fatalf("Issue without a SessionID: got %v, want ParamsError", err)
+	}
+}
+
+func TestFileStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.json")
+	s, err := oauth.NewFileStateStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStateStore: %v", err)
+	}
+	m := oauth.NewStateManager(s, nil)
+	kept, err := m.Issue(oauth.StateEntry{SessionID: "sess", CodeVerifier: "verifier"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	used, err := m.Issue(oauth.StateEntry{SessionID: "sess"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := m.Verify(used, "sess"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	//A restart keeps the open state and not the used one
+	s, err = oauth.NewFileStateStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStateStore after restart: %v", err)
+	}
+	m = oauth.NewStateManager(s, nil)
+	if _, err := m.Verify(used, "sess"); !errors.Is(err, oauth.ErrStateNotFound) {
+		t.Fatalf("Verify of the used state: got %v, want ErrStateNotFound", err)
+	}
+	e, err := m.Verify(kept, "sess")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if e.CodeVerifier != "verifier" {
+		t.Fatalf("CodeVerifier is %q, want verifier", e.CodeVerifier)
+	}
+}
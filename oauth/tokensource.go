@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+var ErrReauthorizationRequired = errors.New("refresh token expired, re-authorization required")
+
+//ExpiresAt is the zero time if the SSO didn't say
+func (t *OAuthToken) ExpiresAt() time.Time {
+	if t.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t.Expires), 0)
+}
+
+func (t *OAuthToken) RefreshExpiresAt() time.Time {
+	if t.RefreshExpires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t.RefreshExpires), 0)
+}
+
+//TokenSource hands out a valid access token
+type TokenSource interface {
+	Token(ctx context.Context) (*OAuthToken, error)
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token *OAuthToken
+	err   error
+}
+
+//RefreshingTokenSource refreshes its token Skew before it expires.
+//Concurrent callers share a single refresh, which runs on the default context of the API
+//so that one caller giving up doesn't fail the others.
+type RefreshingTokenSource struct {
+	OAuth        *OAuth
+	ClientSecret string
+	Skew         time.Duration
+	Now          func() time.Time
+
+	mu       sync.Mutex
+	token    *OAuthToken
+	inflight *refreshCall
+}
+
+//An empty ClientSecret falls back to the one of the configuration of o
+func NewTokenSource(o *OAuth, token *OAuthToken, ClientSecret string) *RefreshingTokenSource {
+	return &RefreshingTokenSource{
+		OAuth:        o,
+		ClientSecret: ClientSecret,
+		Skew:         time.Minute,
+		Now:          time.Now,
+		token:        token,
+	}
+}
+
+//TokenSource starts from o.Token
+func (o *OAuth) TokenSource(ClientSecret string) *RefreshingTokenSource {
+	return NewTokenSource(o, o.Token, ClientSecret)
+}
+
+//NewStoredTokenSource starts from the token the Store of o holds for MaskID.
+//Refreshed tokens are written back, a token that can't be refreshed anymore is deleted.
+func NewStoredTokenSource(o *OAuth, MaskID, ClientSecret string) (*RefreshingTokenSource, error) {
+	t, err := o.StoredToken(MaskID)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenSource(o, t, ClientSecret), nil
+}
+
+func (s *RefreshingTokenSource) valid(t *OAuthToken) bool {
+	exp := t.ExpiresAt()
+	return t.AccessToken != "" && (exp.IsZero() || s.Now().Add(s.Skew).Before(exp))
+}
+
+func (s *RefreshingTokenSource) Token(ctx context.Context) (*OAuthToken, error) {
+	s.mu.Lock()
+	if s.token == nil {
+		s.mu.Unlock()
+		return nil, common.ParamsError
+	}
+	if s.valid(s.token) {
+		//Callers may change what they get, the token of s must stay as it is
+		t := copyToken(s.token)
+		s.mu.Unlock()
+		return t, nil
+	}
+	call := s.inflight
+	if call == nil {
+		if exp := s.token.RefreshExpiresAt(); !exp.IsZero() && s.Now().After(exp) {
+			s.mu.Unlock()
+			return nil, ErrReauthorizationRequired
+		}
+		call = &refreshCall{done: make(chan struct{})}
+		s.inflight = call
+		go s.refresh(call, s.token)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return copyToken(call.token), call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *RefreshingTokenSource) refresh(call *refreshCall, current *OAuthToken) {
+	var opts []string
+	if s.ClientSecret != "" {
+		opts = append(opts, s.ClientSecret)
+	}
+	call.token, call.err = s.OAuth.refresh(s.OAuth.API.Context(), current, opts...)
+	if errors.Is(call.err, common.ErrItemExpiredOrUsed) || errors.Is(call.err, common.ErrCredentialNotMatch) {
+		//The stored token is of no use anymore
+		if err := s.OAuth.DeleteToken(current); err != nil {
+			call.err = fmt.Errorf("%w: %v, deleting the stored token failed: %v", ErrReauthorizationRequired, call.err, err)
+		} else {
+			call.err = fmt.Errorf("%w: %v", ErrReauthorizationRequired, call.err)
+		}
+	}
+
+	s.mu.Lock()
+	//A token that was refreshed but couldn't be stored is still good to use
+	if call.token != nil {
+		s.token = call.token
+	}
+	s.inflight = nil
+	s.mu.Unlock()
+	close(call.done)
+}
@@ -0,0 +1,63 @@
+package oauth_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+)
+
+//failingDelete is a Store that can't delete
+type failingDelete struct {
+	common.TokenStore
+}
+
+func (failingDelete) Delete(common.TokenKey) error {
+	return errors.New("disk full")
+}
+
+func TestTokenSourceHandsOutCopies(t *testing.T) {
+	ts := oauth.NewTokenSource(nil, &oauth.OAuthToken{AccessToken: "at", Scope: []string{"info"}}, "")
+	got, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	got.AccessToken = "changed"
+	got.Scope[0] = "changed"
+	again, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if again.AccessToken != "at" || again.Scope[0] != "info" {
+		t.Fatalf("changing a token changed the source: %+v", again)
+	}
+}
+
+func TestTokenSourceReportsFailedDelete(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	s := o.NewSession()
+	token, err := s.Exchange(ctx, srv.IssueAuthCode("app", maskID(1), nil, "", ""), "")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	//The refresh token is used up by this refresh
+	if _, err := s.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	c := o.Config()
+	c.Store = failingDelete{tokenstore.NewMemory()}
+	if err := o.Configure(c); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+
+	token.Expires = 1
+	_, err = oauth.NewTokenSource(o, token, "").Token(ctx)
+	if !errors.Is(err, oauth.ErrReauthorizationRequired) || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Token: got %v, want ErrReauthorizationRequired with the failed delete", err)
+	}
+}
@@ -0,0 +1,197 @@
+package oauth
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+)
+
+//VerifyStats counts what VerifyCache did since it was created
+type VerifyStats struct {
+	Hits uint64
+	//Hits on a cached invalid token, not included in Hits
+	NegativeHits uint64
+	Misses       uint64
+	//Lookups that waited for an identical one already on the way, not included in Misses
+	Coalesced uint64
+	Evictions uint64
+	Entries   int
+}
+
+type verifyEntry struct {
+	AccessToken string
+	token       *OAuthToken
+	//Set for a negative entry
+	err     error
+	expires time.Time
+}
+
+type verifyCall struct {
+	done  chan struct{}
+	token *OAuthToken
+	err   error
+}
+
+//VerifyCache sits in front of OAuth.VerifyAccessToken.
+//Valid tokens are kept until they expire but at most MaxTTL, invalid ones for NegativeTTL.
+//The least recently used entry is evicted beyond MaxEntries.
+//Concurrent lookups of the same token share one request, which runs on the default context
+//of the API so that one caller giving up doesn't fail the others.
+type VerifyCache struct {
+	OAuth *OAuth
+	//Optional, sent along with the verification
+	ClientSecret string
+	MaxEntries   int
+	//Bounds how long a logged out token may still pass, 0 trusts Expires alone
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	Now         func() time.Time
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*verifyCall
+	stats    VerifyStats
+}
+
+//An empty ClientSecret falls back to the one of the configuration of o
+func NewVerifyCache(o *OAuth, ClientSecret string) *VerifyCache {
+	return &VerifyCache{
+		OAuth:        o,
+		ClientSecret: ClientSecret,
+		MaxEntries:   10000,
+		MaxTTL:       5 * time.Minute,
+		NegativeTTL:  10 * time.Second,
+		Now:          time.Now,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+		inflight:     map[string]*verifyCall{},
+	}
+}
+
+func (c *VerifyCache) Stats() VerifyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.lru.Len()
+	return s
+}
+
+//Verify checks AccessToken like VerifyAccessToken does.
+//An unknown, expired or foreign token gives ErrInvalidBearerToken, other errors mean the SSO couldn't be asked.
+func (c *VerifyCache) Verify(ctx context.Context, AccessToken string) (*OAuthToken, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[AccessToken]; ok {
+		e := el.Value.(*verifyEntry)
+		if c.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			if e.err != nil {
+				c.stats.NegativeHits++
+			} else {
+				c.stats.Hits++
+			}
+			c.mu.Unlock()
+			return copyToken(e.token), e.err
+		}
+		c.remove(el)
+	}
+	call, ok := c.inflight[AccessToken]
+	if ok {
+		c.stats.Coalesced++
+	} else {
+		c.stats.Misses++
+		call = &verifyCall{done: make(chan struct{})}
+		c.inflight[AccessToken] = call
+		go c.lookup(call, AccessToken)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return copyToken(call.token), call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *VerifyCache) lookup(call *verifyCall, AccessToken string) {
+	var opts []string
+	if c.ClientSecret != "" {
+		opts = append(opts, c.ClientSecret)
+	}
+	t, err := c.OAuth.verify(c.OAuth.API.Context(), AccessToken, opts...)
+	now := c.Now()
+	var expires time.Time
+	if err != nil {
+		var apiErr *common.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.Code {
+			case common.ITEM_NOT_FOUND_ERROR, common.ITEM_EXPIRED_OR_USED_ERROR,
+				common.CREDENTIAL_NOT_MATCH, common.PERMISSION_DENIED:
+				err = fmt.Errorf("%w: %v", ErrInvalidBearerToken, err)
+				expires = now.Add(c.NegativeTTL)
+			}
+		}
+	} else {
+		exp := t.ExpiresAt()
+		if t.ClientID != c.OAuth.ClientID() || (!exp.IsZero() && !now.Before(exp)) {
+			t, err = nil, ErrInvalidBearerToken
+			expires = now.Add(c.NegativeTTL)
+		} else {
+			//Nobody verifying a token has business with its refresh token
+			t.RefreshToken = ""
+			t.AccessToken = AccessToken
+			expires = exp
+			if c.MaxTTL > 0 && (expires.IsZero() || now.Add(c.MaxTTL).Before(expires)) {
+				expires = now.Add(c.MaxTTL)
+			}
+		}
+	}
+	call.token, call.err = t, err
+
+	c.mu.Lock()
+	delete(c.inflight, AccessToken)
+	//Transport errors and tokens without known lifetime aren't cached
+	if now.Before(expires) {
+		c.add(&verifyEntry{
+			AccessToken: AccessToken,
+			token:       t,
+			err:         err,
+			expires:     expires,
+		})
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+//add expects c.mu to be held
+func (c *VerifyCache) add(e *verifyEntry) {
+	if el, ok := c.entries[e.AccessToken]; ok {
+		c.remove(el)
+	}
+	c.entries[e.AccessToken] = c.lru.PushFront(e)
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *VerifyCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*verifyEntry).AccessToken)
+}
+
+//copyToken keeps callers from changing the cached token
+func copyToken(t *OAuthToken) *OAuthToken {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Scope = append([]string(nil), t.Scope...)
+	return &c
+}
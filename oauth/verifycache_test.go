@@ -0,0 +1,129 @@
+package oauth_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/ssotest"
+)
+
+//issueTokens exchanges a code for each of the first n masks
+func issueTokens(t *testing.T, srv *ssotest.Server, o *oauth.OAuth, n int) []*oauth.OAuthToken {
+	t.Helper()
+	tokens := make([]*oauth.OAuthToken, n)
+	for i := range tokens {
+		code := srv.IssueAuthCode("app", maskID(i+1), nil, "", "")
+		token, err := o.NewSession().Exchange(srv.API().Context(), code, "")
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		tokens[i] = token
+	}
+	return tokens
+}
+
+func TestVerifyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	tokens := issueTokens(t, srv, o, 3)
+	cache := oauth.NewVerifyCache(o, "")
+	cache.MaxEntries = 2
+
+	for _, i := range []int{0, 1, 0, 2} {
+		if _, err := cache.Verify(ctx, tokens[i].AccessToken); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+	//tokens[1] was used least recently and went for tokens[2]
+	want := oauth.VerifyStats{Hits: 1, Misses: 3, Evictions: 1, Entries: 2}
+	if got := cache.Stats(); got != want {
+		t.Fatalf("Stats %+v, want %+v", got, want)
+	}
+	cache.Verify(ctx, tokens[0].AccessToken)
+	cache.Verify(ctx, tokens[1].AccessToken)
+	if got := cache.Stats(); got.Hits != 2 || got.Misses != 4 {
+		t.Fatalf("Stats %+v, want tokens[0] cached and tokens[1] not", got)
+	}
+}
+
+func TestVerifyCacheNegativeTTL(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	ctx := srv.API().Context()
+	cache := oauth.NewVerifyCache(o, "")
+	now := time.Now()
+	cache.Now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Verify(ctx, "unknown"); !errors.Is(err, oauth.ErrInvalidBearerToken) {
+			t.Fatalf("Verify: got %v, want ErrInvalidBearerToken", err)
+		}
+	}
+	if got := cache.Stats(); got.NegativeHits != 1 || got.Misses != 1 {
+		t.Fatalf("Stats %+v, want the second lookup answered from the cache", got)
+	}
+	now = now.Add(cache.NegativeTTL + time.Second)
+	cache.Verify(ctx, "unknown")
+	if got := cache.Stats(); got.NegativeHits != 1 || got.Misses != 2 {
+		t.Fatalf("Stats %+v, want the lookup after NegativeTTL to go to the SSO", got)
+	}
+
+	//A failure to reach the SSO is not an answer about the token
+	srv.InjectError("GET", "/oauth_token/verified_status", 503, 0)
+	if _, err := cache.Verify(ctx, "other"); err == nil || errors.Is(err, oauth.ErrInvalidBearerToken) {
+		t.Fatalf("Verify while the SSO fails: got %v", err)
+	}
+	if got := cache.Stats(); got.Entries != 1 {
+		t.Fatalf("Stats %+v, want the failed lookup not cached", got)
+	}
+}
+
+func TestVerifyCacheCoalesces(t *testing.T) {
+	srv, o := setup(t, oauth.ClientConfig{ClientSecret: "s3cret"})
+	token := issueTokens(t, srv, o, 1)[0]
+
+	//Hold every verification until all lookups are waiting
+	var mu sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	a := srv.API()
+	a.Middleware = []api.Middleware{func(next api.RoundTripFunc) api.RoundTripFunc {
+		return func(req *api.Request) (*api.Response, error) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			<-release
+			return next(req)
+		}
+	}}
+	o.API = a
+	cache := oauth.NewVerifyCache(o, "")
+
+	const callers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := cache.Verify(context.Background(), token.AccessToken); err != nil || got.MaskID != token.MaskID {
+				t.Errorf("Verify: %+v, %v", got, err)
+			}
+		}()
+	}
+	for s := cache.Stats(); s.Misses+s.Coalesced < callers; s = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if requests != 1 {
+		t.Fatalf("%d requests to the SSO, want 1", requests)
+	}
+	if got := cache.Stats(); got.Misses != 1 || got.Coalesced != callers-1 {
+		t.Fatalf("Stats %+v, want 1 miss and %d coalesced", got, callers-1)
+	}
+}
@@ -0,0 +1,365 @@
+package ssotest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//Purposes of a verification code
+const (
+	PurposeVerifyEmail    = "verifyEmail"
+	PurposeVerifyPhone    = "verifyPhone"
+	PurposeChangeEmail    = "changeEmail"
+	PurposeChangePhone    = "changePhone"
+	PurposeChangePassword = "changePassword"
+)
+
+//VeriCode is a verification code the emulated SSO has "sent"
+type VeriCode struct {
+	Code    string    `json:"code"`
+	Purpose string    `json:"purpose"`
+	UID     int       `json:"uid"`
+	Target  string    `json:"target"`
+	Method  int       `json:"method"`
+	Used    bool      `json:"used"`
+	Expires time.Time `json:"expires"`
+}
+
+//Notification is a message sent through the notification endpoint
+type Notification struct {
+	MaskID   string    `json:"mask_id"`
+	ClientID string    `json:"client_id"`
+	Title    string    `json:"title"`
+	Content  string    `json:"content"`
+	IsSales  bool      `json:"is_sales"`
+	Method   int       `json:"method"`
+	Sent     time.Time `json:"sent"`
+}
+
+type UserRecord struct {
+	user.UserEntity
+	Password string `json:"password"`
+}
+
+type Client struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type AuthCode struct {
+	Code                string    `json:"code"`
+	ClientID            string    `json:"client_id"`
+	MaskID              string    `json:"mask_id"`
+	Scope               []string  `json:"scope"`
+	CodeChallenge       string    `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string    `json:"code_challenge_type,omitempty"`
+	Expires             time.Time `json:"expires"`
+}
+
+type UserToken struct {
+	UID           int       `json:"uid"`
+	AccessToken   string    `json:"access_token"`
+	RefreshToken  string    `json:"refresh_token"`
+	Expires       time.Time `json:"expires"`
+	RefreshExpire time.Time `json:"refresh_expire"`
+}
+
+//State is everything the emulated SSO keeps in memory
+type State struct {
+	NextUID       int                           `json:"next_uid"`
+	Users         map[int]*UserRecord           `json:"users"`
+	UserTokens    map[string]*UserToken         `json:"user_tokens"`
+	VeriCodes     []*VeriCode                   `json:"vericodes"`
+	Masks         map[string]*user.MaskIDEntity `json:"masks"`
+	Clients       map[string]*Client            `json:"clients"`
+	AuthCodes     map[string]*AuthCode          `json:"auth_codes"`
+	OAuthTokens   map[string]*oauth.OAuthToken  `json:"oauth_tokens"`
+	Notifications []*Notification               `json:"notifications"`
+}
+
+func newState() *State {
+	return &State{
+		NextUID:     1,
+		Users:       map[int]*UserRecord{},
+		UserTokens:  map[string]*UserToken{},
+		Masks:       map[string]*user.MaskIDEntity{},
+		Clients:     map[string]*Client{},
+		AuthCodes:   map[string]*AuthCode{},
+		OAuthTokens: map[string]*oauth.OAuthToken{},
+	}
+}
+
+type injection struct {
+	Method     string
+	Path       string
+	StatusCode int
+	ErrCode    int
+}
+
+//Backend is the emulated InteractiveSSO API, an http.Handler.
+//All exported methods are safe to call while requests are being served.
+type Backend struct {
+	TokenTTL   time.Duration
+	RefreshTTL time.Duration
+	CodeTTL    time.Duration
+	//Clock of the emulator, replace it to test expiry
+	Now func() time.Time
+	//Called for every verification code and notification that gets "sent".
+	//They run while the Backend is locked and must not call back into it.
+	OnVeriCode     func(VeriCode)
+	OnNotification func(Notification)
+
+	mu         sync.Mutex
+	state      *State
+	injections []injection
+}
+
+func NewBackend() *Backend {
+	return &Backend{
+		TokenTTL:   time.Hour,
+		RefreshTTL: 30 * 24 * time.Hour,
+		CodeTTL:    15 * time.Minute,
+		Now:        time.Now,
+		state:      newState(),
+	}
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//AddUser stores u with Password, a zero UID gets the next free one
+func (b *Backend) AddUser(u user.UserEntity, Password string) user.UserEntity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if u.UID == 0 {
+		u.UID = b.state.NextUID
+	}
+	if u.UID >= b.state.NextUID {
+		b.state.NextUID = u.UID + 1
+	}
+	b.state.Users[u.UID] = &UserRecord{
+		UserEntity: u,
+		Password:   Password,
+	}
+	return u
+}
+
+func (b *Backend) AddClient(ClientID, ClientSecret string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state.Clients[ClientID] = &Client{
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+	}
+}
+
+//AddMask stores m, an empty MaskId gets a random one
+func (b *Backend) AddMask(m user.MaskIDEntity) user.MaskIDEntity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m.MaskId == "" {
+		m.MaskId = randomString(8)
+	}
+	if m.CreateTime == 0 {
+		m.CreateTime = int(b.Now().Unix())
+	}
+	b.state.Masks[m.MaskId] = &m
+	return m
+}
+
+//IssueAuthCode stands in for the consent page: it returns an authorization code
+//that POST /oauth_token exchanges for a token of MaskID.
+//CodeChallenge and CodeChallengeMethod (S256 or plain) may be left empty.
+func (b *Backend) IssueAuthCode(ClientID, MaskID string, Scope []string, CodeChallenge, CodeChallengeMethod string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	code := randomString(16)
+	b.state.AuthCodes[code] = &AuthCode{
+		Code:                code,
+		ClientID:            ClientID,
+		MaskID:              MaskID,
+		Scope:               Scope,
+		CodeChallenge:       CodeChallenge,
+		CodeChallengeMethod: CodeChallengeMethod,
+		Expires:             b.Now().Add(b.CodeTTL),
+	}
+	return code
+}
+
+//InjectError makes the next request matching Method and Path fail with ErrCode.
+//Path is the exact URL path, e.g. /user/token. Calling it twice fails two requests.
+func (b *Backend) InjectError(Method, Path string, StatusCode, ErrCode int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.injections = append(b.injections, injection{
+		Method:     Method,
+		Path:       Path,
+		StatusCode: StatusCode,
+		ErrCode:    ErrCode,
+	})
+}
+
+//VeriCodes returns every verification code sent so far, oldest first
+func (b *Backend) VeriCodes() []VeriCode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make([]VeriCode, 0, len(b.state.VeriCodes))
+	for _, v := range b.state.VeriCodes {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+//LastVeriCode returns the newest code sent to Target (an email address or phone number)
+func (b *Backend) LastVeriCode(Target string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.state.VeriCodes) - 1; i >= 0; i-- {
+		if b.state.VeriCodes[i].Target == Target {
+			return b.state.VeriCodes[i].Code, true
+		}
+	}
+	return "", false
+}
+
+//Notifications returns every notification sent so far, oldest first
+func (b *Backend) Notifications() []Notification {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make([]Notification, 0, len(b.state.Notifications))
+	for _, v := range b.state.Notifications {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+//User returns the stored user, including unverified email and phone
+func (b *Backend) User(UID int) (user.UserEntity, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := b.state.Users[UID]
+	if !ok {
+		return user.UserEntity{}, false
+	}
+	return u.UserEntity, true
+}
+
+//The methods below expect b.mu to be held
+
+func (b *Backend) takeInjection(Method, Path string) (injection, bool) {
+	for i, v := range b.injections {
+		if v.Method == Method && v.Path == Path {
+			b.injections = append(b.injections[:i], b.injections[i+1:]...)
+			return v, true
+		}
+	}
+	return injection{}, false
+}
+
+func (b *Backend) sendCode(Purpose string, UID int, Target string, Method int) *VeriCode {
+	v := &VeriCode{
+		Code:    randomString(8),
+		Purpose: Purpose,
+		UID:     UID,
+		Target:  Target,
+		Method:  Method,
+		Expires: b.Now().Add(b.CodeTTL),
+	}
+	b.state.VeriCodes = append(b.state.VeriCodes, v)
+	if b.OnVeriCode != nil {
+		b.OnVeriCode(*v)
+	}
+	return v
+}
+
+//useCode marks a code as used, it is looked up by code, purpose and (unless 0) uid
+func (b *Backend) useCode(Code, Purpose string, UID int) (*VeriCode, *apiError) {
+	for _, v := range b.state.VeriCodes {
+		if v.Code != Code || v.Purpose != Purpose || (UID != 0 && v.UID != UID) {
+			continue
+		}
+		if v.Used || b.Now().After(v.Expires) {
+			return nil, errExpired("veriCode")
+		}
+		v.Used = true
+		return v, nil
+	}
+	return nil, errNotFound("veriCode")
+}
+
+func (b *Backend) findUser(Username, Email, Phone string) *UserRecord {
+	for _, u := range b.state.Users {
+		if (Username != "" && u.Username == Username) ||
+			(Email != "" && u.Email == Email) ||
+			(Phone != "" && u.Phone == Phone) {
+			return u
+		}
+	}
+	return nil
+}
+
+//authUser checks a user access token, as sent by the user package
+func (b *Backend) authUser(UID int, AccessToken string) (*UserRecord, *apiError) {
+	t, ok := b.state.UserTokens[AccessToken]
+	if !ok || t.UID != UID {
+		return nil, errCredential("access_token")
+	}
+	if b.Now().After(t.Expires) {
+		return nil, errExpired("access_token")
+	}
+	u, ok := b.state.Users[UID]
+	if !ok {
+		return nil, errNotFound("user")
+	}
+	return u, nil
+}
+
+func (b *Backend) issueUserToken(UID int) *UserToken {
+	now := b.Now()
+	t := &UserToken{
+		UID:           UID,
+		AccessToken:   randomString(16),
+		RefreshToken:  randomString(16),
+		Expires:       now.Add(b.TokenTTL),
+		RefreshExpire: now.Add(b.RefreshTTL),
+	}
+	b.state.UserTokens[t.AccessToken] = t
+	return t
+}
+
+func (b *Backend) issueOAuthToken(ClientID, MaskID string, Scope []string, ObtainedMethod int) *oauth.OAuthToken {
+	now := int(b.Now().Unix())
+	t := &oauth.OAuthToken{
+		AccessToken:    randomString(16),
+		RefreshToken:   randomString(16),
+		ObtainedMethod: ObtainedMethod,
+		Issued:         now,
+		Expires:        now + int(b.TokenTTL/time.Second),
+		LastRenewed:    now,
+		RefreshExpires: now + int(b.RefreshTTL/time.Second),
+		MaskID:         MaskID,
+		ClientID:       ClientID,
+		Scope:          Scope,
+	}
+	b.state.OAuthTokens[t.AccessToken] = t
+	return t
+}
+
+//phoneSentMethod picks the channel for a code going to a phone number
+func phoneSentMethod(Preferred int) int {
+	if Preferred == common.PHONE_CALL {
+		return common.PHONE_CALL
+	}
+	return common.SMS_MESSAGE
+}
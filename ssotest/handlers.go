@@ -0,0 +1,952 @@
+package ssotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/oauth"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+type apiError struct {
+	StatusCode int
+	Result     common.GeneralResult
+}
+
+func statusFor(ErrCode int) int {
+	switch ErrCode {
+	case common.INNER_ARGUMENT_ERROR, common.REQUEST_PARAM_FORMAT_ERROR, common.ITEM_EXPIRED_OR_USED_ERROR:
+		return http.StatusBadRequest
+	case common.ITEM_NOT_FOUND_ERROR:
+		return http.StatusNotFound
+	case common.ITEM_ALREADY_EXIST_ERROR:
+		return http.StatusConflict
+	case common.PERMISSION_DENIED:
+		return http.StatusForbidden
+	case common.CREDENTIAL_NOT_MATCH:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+func newError(ErrCode int, Description string) *apiError {
+	return &apiError{
+		StatusCode: statusFor(ErrCode),
+		Result: common.GeneralResult{
+			ErrCode:          ErrCode,
+			ErrorDescription: Description,
+		},
+	}
+}
+
+func errParam(Param string) *apiError {
+	e := newError(common.REQUEST_PARAM_FORMAT_ERROR, "request param format error")
+	e.Result.ErrorParam = Param
+	return e
+}
+
+func errNotFound(Item string) *apiError {
+	e := newError(common.ITEM_NOT_FOUND_ERROR, "item not found")
+	e.Result.Item = Item
+	return e
+}
+
+func errExists(Item string) *apiError {
+	e := newError(common.ITEM_ALREADY_EXIST_ERROR, "item already exists")
+	e.Result.Item = Item
+	return e
+}
+
+func errExpired(Item string) *apiError {
+	e := newError(common.ITEM_EXPIRED_OR_USED_ERROR, "item expired or used")
+	e.Result.Item = Item
+	return e
+}
+
+func errCredential(Credential string) *apiError {
+	e := newError(common.CREDENTIAL_NOT_MATCH, "credential not match")
+	e.Result.Credential = Credential
+	return e
+}
+
+func errPermission(Description string) *apiError {
+	return newError(common.PERMISSION_DENIED, Description)
+}
+
+//params holds query and body parameters of a request.
+//The user package sends numbers both as JSON numbers and as strings, so both are accepted.
+type params map[string]json.RawMessage
+
+func readParams(r *http.Request) (params, error) {
+	p := params{}
+	for k, v := range r.URL.Query() {
+		raw, _ := json.Marshal(v[0])
+		p[k] = raw
+	}
+	if r.Body == nil {
+		return p, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return p, nil
+	}
+	//PATCH bodies are wrapped in an array, see api.PatchURL
+	if body[0] == '[' {
+		var arr []params
+		if err := json.Unmarshal(body, &arr); err != nil {
+			return nil, err
+		}
+		for _, v := range arr {
+			for k, raw := range v {
+				p[k] = raw
+			}
+		}
+		return p, nil
+	}
+	var obj params
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	for k, raw := range obj {
+		p[k] = raw
+	}
+	return p, nil
+}
+
+func (p params) str(key string) string {
+	raw, ok := p[key]
+	if !ok || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+func (p params) integer(key string) (int, *apiError) {
+	v, err := strconv.Atoi(p.str(key))
+	if err != nil {
+		return 0, errParam(key)
+	}
+	return v, nil
+}
+
+func (p params) boolean(key string) bool {
+	switch p.str(key) {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+func (p params) require(keys ...string) *apiError {
+	for _, k := range keys {
+		if p.str(k) == "" {
+			return errParam(k)
+		}
+	}
+	return nil
+}
+
+func writeResult(w http.ResponseWriter, StatusCode int, ret common.GeneralResult) {
+	if StatusCode == http.StatusNoContent {
+		w.WriteHeader(StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(StatusCode)
+	json.NewEncoder(w).Encode(ret)
+}
+
+//match compares path segments against a pattern where "*" captures one segment
+func match(segs []string, pattern ...string) ([]string, bool) {
+	if len(segs) != len(pattern) {
+		return nil, false
+	}
+	var captured []string
+	for i, v := range pattern {
+		if v == "*" {
+			captured = append(captured, segs[i])
+		} else if v != segs[i] {
+			return nil, false
+		}
+	}
+	return captured, true
+}
+
+type handlerFunc func(b *Backend, args []string, p params) (int, interface{}, *apiError)
+
+type route struct {
+	Method  string
+	Pattern []string
+	Handler handlerFunc
+}
+
+var routes = []route{
+	{"POST", []string{"user"}, handleRegister},
+	{"PATCH", []string{"user"}, handleModifyUser},
+	{"GET", []string{"vericodes", "verifyEmailResult", "*"}, handleVerifyEmail},
+	{"GET", []string{"vericodes", "verifyPhoneResult", "*"}, handleVerifyPhone},
+	{"POST", []string{"vericodes", "sendAnotherVerifyEmailRequest"}, handleResendEmail},
+	{"POST", []string{"vericodes", "sendAnotherVerifyPhoneRequest"}, handleResendPhone},
+	{"POST", []string{"vericodes", "changeEmailAddrRequest"}, handleChangeEmailRequest},
+	{"POST", []string{"vericodes", "changePhoneNumberRequest"}, handleChangePhoneRequest},
+	{"POST", []string{"vericodes", "changePasswordRequest"}, handleChangePasswordRequest},
+	{"POST", []string{"user", "token"}, handleLogin},
+	{"GET", []string{"user", "*", "token", "*", "checkTokenResult"}, handleCheckToken},
+	{"GET", []string{"user", "*", "token", "refreshResult"}, handleRefreshLogin},
+	{"DELETE", []string{"user", "*", "token", "*"}, handleLogout},
+	{"PATCH", []string{"user", "email"}, handlePatchEmail},
+	{"PATCH", []string{"user", "phoneNum"}, handlePatchPhone},
+	{"PATCH", []string{"user", "password"}, handlePatchPassword},
+	{"GET", []string{"masks"}, handleListMasks},
+	{"GET", []string{"masks", "*"}, handleGetMask},
+	{"POST", []string{"masks", "*"}, handleAddMask},
+	{"PATCH", []string{"masks", "*"}, handleModifyMask},
+	{"DELETE", []string{"masks", "*"}, handleDeleteMask},
+	{"POST", []string{"oauth_token"}, handleOAuthToken},
+	{"GET", []string{"oauth_token", "verified_status"}, handleOAuthVerify},
+	{"GET", []string{"oauth_token", "refresh_result"}, handleOAuthRefresh},
+	{"GET", []string{"oauth_ability", "user_info"}, handleOAuthUserInfo},
+	{"POST", []string{"oauth_ability", "notifications"}, handleOAuthNotification},
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if inj, ok := b.takeInjection(r.Method, r.URL.Path); ok {
+		status := inj.StatusCode
+		if status == 0 {
+			status = statusFor(inj.ErrCode)
+		}
+		writeResult(w, status, common.GeneralResult{
+			ErrCode:          inj.ErrCode,
+			ErrorDescription: "injected error",
+		})
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == oauth.AuthorizePath {
+		b.handleConsent(w, r)
+		return
+	}
+
+	p, err := readParams(r)
+	if err != nil {
+		e := errParam("body")
+		writeResult(w, e.StatusCode, e.Result)
+		return
+	}
+
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, rt := range routes {
+		if rt.Method != r.Method {
+			continue
+		}
+		args, ok := match(segs, rt.Pattern...)
+		if !ok {
+			continue
+		}
+		status, data, e := rt.Handler(b, args, p)
+		if e != nil {
+			writeResult(w, e.StatusCode, e.Result)
+			return
+		}
+		ret := common.GeneralResult{
+			ErrCode: common.NO_ERROR,
+		}
+		if data != nil {
+			ret.Data, _ = json.Marshal(data)
+		}
+		writeResult(w, status, ret)
+		return
+	}
+	e := errNotFound("endpoint")
+	writeResult(w, e.StatusCode, e.Result)
+}
+
+func handleRegister(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("username", "password", "captcha_id"); e != nil {
+		return 0, nil, e
+	}
+	if b.findUser(p.str("username"), "", "") != nil {
+		return 0, nil, errExists("username")
+	}
+	if b.findUser("", p.str("email"), "") != nil {
+		return 0, nil, errExists("email")
+	}
+	if b.findUser("", "", p.str("phone")) != nil {
+		return 0, nil, errExists("phone")
+	}
+	u := &UserRecord{
+		UserEntity: user.UserEntity{
+			UID:      b.state.NextUID,
+			Username: p.str("username"),
+			Email:    p.str("email"),
+			Phone:    p.str("phone"),
+		},
+		Password: p.str("password"),
+	}
+	b.state.NextUID++
+	b.state.Users[u.UID] = u
+
+	ret := &user.RegisterRes{
+		UID:      u.UID,
+		Username: u.Username,
+		Email:    u.Email,
+		Phone:    u.Phone,
+	}
+	if u.Email != "" {
+		b.sendCode(PurposeVerifyEmail, u.UID, u.Email, common.EMAIL)
+	}
+	if u.Phone != "" {
+		ret.PhoneVerificationSentMethod = b.sendCode(PurposeVerifyPhone, u.UID, u.Phone, common.SMS_MESSAGE).Method
+	}
+	return http.StatusCreated, ret, nil
+}
+
+func handleModifyUser(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	u, e := b.authUser(uid, p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	if v := p.str("nickname"); v != "" {
+		u.Nickname = v
+	}
+	if v := p.str("signature"); v != "" {
+		u.Signature = v
+	}
+	if raw, ok := p["settings"]; ok {
+		if err := json.Unmarshal(raw, &u.Settings); err != nil {
+			return 0, nil, errParam("settings")
+		}
+	}
+	return http.StatusOK, nil, nil
+}
+
+func handleVerifyEmail(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	v, e := b.useCode(args[0], PurposeVerifyEmail, 0)
+	if e != nil {
+		return 0, nil, e
+	}
+	u, ok := b.state.Users[v.UID]
+	if !ok {
+		return 0, nil, errNotFound("user")
+	}
+	u.EmailVerified = true
+	return http.StatusOK, &user.VerifyEmailRes{
+		Username: u.Username,
+		Nickname: u.Nickname,
+		Email:    u.Email,
+	}, nil
+}
+
+func handleVerifyPhone(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	v, e := b.useCode(args[0], PurposeVerifyPhone, uid)
+	if e != nil {
+		return 0, nil, e
+	}
+	u, ok := b.state.Users[v.UID]
+	if !ok {
+		return 0, nil, errNotFound("user")
+	}
+	u.PhoneVerified = true
+	return http.StatusOK, &user.VerifyPhoneRes{
+		Username: u.Username,
+		Nickname: u.Nickname,
+		Phone:    u.Phone,
+	}, nil
+}
+
+func handleResendEmail(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("email", "captcha_id"); e != nil {
+		return 0, nil, e
+	}
+	u := b.findUser("", p.str("email"), "")
+	if u == nil {
+		return 0, nil, errNotFound("email")
+	}
+	if u.EmailVerified {
+		return 0, nil, errExpired("email")
+	}
+	b.sendCode(PurposeVerifyEmail, u.UID, u.Email, common.EMAIL)
+	return http.StatusCreated, nil, nil
+}
+
+func handleResendPhone(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("phone", "captcha_id"); e != nil {
+		return 0, nil, e
+	}
+	u := b.findUser("", "", p.str("phone"))
+	if u == nil {
+		return 0, nil, errNotFound("phone")
+	}
+	if u.PhoneVerified {
+		return 0, nil, errExpired("phone")
+	}
+	preferred, _ := p.integer("preferred_send_method")
+	v := b.sendCode(PurposeVerifyPhone, u.UID, u.Phone, phoneSentMethod(preferred))
+	return http.StatusCreated, &common.SENT_METHOD{IotaNum: v.Method}, nil
+}
+
+func handleChangeEmailRequest(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if _, e := b.authUser(uid, p.str("access_token")); e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("new_email"); e != nil {
+		return 0, nil, e
+	}
+	if b.findUser("", p.str("new_email"), "") != nil {
+		return 0, nil, errExists("email")
+	}
+	v := b.sendCode(PurposeChangeEmail, uid, p.str("new_email"), common.EMAIL)
+	return http.StatusCreated, &common.SENT_METHOD{IotaNum: v.Method}, nil
+}
+
+func handleChangePhoneRequest(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if _, e := b.authUser(uid, p.str("access_token")); e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("new_phone"); e != nil {
+		return 0, nil, e
+	}
+	if b.findUser("", "", p.str("new_phone")) != nil {
+		return 0, nil, errExists("phone")
+	}
+	preferred, _ := p.integer("preferred_send_method")
+	v := b.sendCode(PurposeChangePhone, uid, p.str("new_phone"), phoneSentMethod(preferred))
+	return http.StatusCreated, &common.SENT_METHOD{IotaNum: v.Method}, nil
+}
+
+func handleChangePasswordRequest(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	u, e := b.authUser(uid, p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	preferred, _ := p.integer("preferred_send_method")
+	var v *VeriCode
+	switch {
+	case u.Email != "" && (preferred == common.EMAIL || u.Phone == ""):
+		v = b.sendCode(PurposeChangePassword, uid, u.Email, common.EMAIL)
+	case u.Phone != "":
+		v = b.sendCode(PurposeChangePassword, uid, u.Phone, phoneSentMethod(preferred))
+	default:
+		return 0, nil, errNotFound("email")
+	}
+	return http.StatusCreated, &common.SENT_METHOD{IotaNum: v.Method}, nil
+}
+
+func loginRes(u *UserRecord, t *UserToken) *user.LoginRes {
+	return &user.LoginRes{
+		AccessToken:   t.AccessToken,
+		RefreshToken:  t.RefreshToken,
+		ExpireTime:    int(t.Expires.Unix()),
+		RefreshExpire: int(t.RefreshExpire.Unix()),
+		User:          u.UserEntity,
+		UID:           u.UID,
+	}
+}
+
+func handleLogin(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("password", "captcha_id"); e != nil {
+		return 0, nil, e
+	}
+	u := b.findUser(p.str("username"), p.str("email"), p.str("phone"))
+	if u == nil {
+		return 0, nil, errNotFound("user")
+	}
+	if u.Password != p.str("password") {
+		return 0, nil, errCredential("password")
+	}
+	if u.AccountFrozen {
+		return 0, nil, errPermission("account frozen")
+	}
+	return http.StatusCreated, loginRes(u, b.issueUserToken(u.UID)), nil
+}
+
+func handleCheckToken(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, nil, errParam("uid")
+	}
+	if _, e := b.authUser(uid, args[1]); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, nil, nil
+}
+
+func handleRefreshLogin(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, nil, errParam("uid")
+	}
+	for k, t := range b.state.UserTokens {
+		if t.UID != uid || t.RefreshToken != p.str("refresh_token") {
+			continue
+		}
+		if b.Now().After(t.RefreshExpire) {
+			return 0, nil, errExpired("refresh_token")
+		}
+		u, ok := b.state.Users[uid]
+		if !ok {
+			return 0, nil, errNotFound("user")
+		}
+		delete(b.state.UserTokens, k)
+		return http.StatusCreated, loginRes(u, b.issueUserToken(uid)), nil
+	}
+	return 0, nil, errCredential("refresh_token")
+}
+
+func handleLogout(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, nil, errParam("uid")
+	}
+	if _, e := b.authUser(uid, args[1]); e != nil {
+		return 0, nil, e
+	}
+	delete(b.state.UserTokens, args[1])
+	return http.StatusNoContent, nil, nil
+}
+
+//handlePatchEmail adds an email to an account without one (new_email),
+//or applies a change requested through changeEmailAddrRequest (veriCode)
+func handlePatchEmail(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if code := p.str("veriCode"); code != "" {
+		v, e := b.useCode(code, PurposeChangeEmail, uid)
+		if e != nil {
+			return 0, nil, e
+		}
+		u, ok := b.state.Users[uid]
+		if !ok {
+			return 0, nil, errNotFound("user")
+		}
+		u.Email = v.Target
+		u.EmailVerified = true
+		return http.StatusOK, nil, nil
+	}
+	u, e := b.authUser(uid, p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("new_email"); e != nil {
+		return 0, nil, e
+	}
+	if u.Email != "" {
+		return 0, nil, errExists("email")
+	}
+	u.Email = p.str("new_email")
+	b.sendCode(PurposeVerifyEmail, uid, u.Email, common.EMAIL)
+	return http.StatusOK, nil, nil
+}
+
+func handlePatchPhone(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if code := p.str("veriCode"); code != "" {
+		v, e := b.useCode(code, PurposeChangePhone, uid)
+		if e != nil {
+			return 0, nil, e
+		}
+		u, ok := b.state.Users[uid]
+		if !ok {
+			return 0, nil, errNotFound("user")
+		}
+		u.Phone = v.Target
+		u.PhoneVerified = true
+		return http.StatusOK, nil, nil
+	}
+	u, e := b.authUser(uid, p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("new_phone"); e != nil {
+		return 0, nil, e
+	}
+	if u.Phone != "" {
+		return 0, nil, errExists("phone")
+	}
+	u.Phone = p.str("new_phone")
+	b.sendCode(PurposeVerifyPhone, uid, u.Phone, common.SMS_MESSAGE)
+	return http.StatusOK, nil, nil
+}
+
+func handlePatchPassword(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("veriCode", "new_password"); e != nil {
+		return 0, nil, e
+	}
+	if _, e := b.useCode(p.str("veriCode"), PurposeChangePassword, uid); e != nil {
+		return 0, nil, e
+	}
+	u, ok := b.state.Users[uid]
+	if !ok {
+		return 0, nil, errNotFound("user")
+	}
+	u.Password = p.str("new_password")
+	return http.StatusOK, nil, nil
+}
+
+func (b *Backend) authMask(MaskID string, p params) (*user.MaskIDEntity, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return nil, e
+	}
+	if _, e := b.authUser(uid, p.str("access_token")); e != nil {
+		return nil, e
+	}
+	m, ok := b.state.Masks[MaskID]
+	if !ok || m.UID != uid {
+		return nil, errNotFound("mask_id")
+	}
+	return m, nil
+}
+
+func handleListMasks(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if _, e := b.authUser(uid, p.str("access_token")); e != nil {
+		return 0, nil, e
+	}
+	ret := []*user.MaskIDEntity{}
+	for _, m := range b.state.Masks {
+		if m.UID == uid {
+			ret = append(ret, m)
+		}
+	}
+	return http.StatusOK, ret, nil
+}
+
+func handleGetMask(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	m, e := b.authMask(args[0], p)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, m, nil
+}
+
+func handleAddMask(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	uid, e := p.integer("uid")
+	if e != nil {
+		return 0, nil, e
+	}
+	if _, e := b.authUser(uid, p.str("access_token")); e != nil {
+		return 0, nil, e
+	}
+	if _, ok := b.state.Clients[args[0]]; !ok {
+		return 0, nil, errNotFound("client_id")
+	}
+	m := &user.MaskIDEntity{
+		MaskId:      randomString(8),
+		ClientID:    args[0],
+		UID:         uid,
+		DisplayName: p.str("display_name"),
+		CreateTime:  int(b.Now().Unix()),
+	}
+	if raw, ok := p["settings"]; ok {
+		if err := json.Unmarshal(raw, &m.Settings); err != nil {
+			return 0, nil, errParam("settings")
+		}
+	}
+	b.state.Masks[m.MaskId] = m
+	return http.StatusCreated, m, nil
+}
+
+func handleModifyMask(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	m, e := b.authMask(args[0], p)
+	if e != nil {
+		return 0, nil, e
+	}
+	if v := p.str("display_name"); v != "" {
+		m.DisplayName = v
+	}
+	if raw, ok := p["settings"]; ok {
+		if err := json.Unmarshal(raw, &m.Settings); err != nil {
+			return 0, nil, errParam("settings")
+		}
+	}
+	return http.StatusOK, m, nil
+}
+
+func handleDeleteMask(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	m, e := b.authMask(args[0], p)
+	if e != nil {
+		return 0, nil, e
+	}
+	delete(b.state.Masks, m.MaskId)
+	return http.StatusNoContent, nil, nil
+}
+
+func (b *Backend) authClient(ClientID, ClientSecret string) *apiError {
+	c, ok := b.state.Clients[ClientID]
+	if !ok {
+		return errNotFound("client_id")
+	}
+	if ClientSecret != "" && c.ClientSecret != ClientSecret {
+		return errCredential("client_secret")
+	}
+	return nil
+}
+
+func (b *Backend) authOAuthToken(AccessToken string) (*oauth.OAuthToken, *apiError) {
+	t, ok := b.state.OAuthTokens[AccessToken]
+	if !ok {
+		return nil, errCredential("access_token")
+	}
+	if int(b.Now().Unix()) > t.Expires {
+		return nil, errExpired("access_token")
+	}
+	return t, nil
+}
+
+func handleOAuthToken(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("code", "client_id"); e != nil {
+		return 0, nil, e
+	}
+	c, ok := b.state.AuthCodes[p.str("code")]
+	if !ok || c.ClientID != p.str("client_id") {
+		return 0, nil, errNotFound("code")
+	}
+	//Authorization codes are single use, even if the exchange fails
+	delete(b.state.AuthCodes, c.Code)
+	if b.Now().After(c.Expires) {
+		return 0, nil, errExpired("code")
+	}
+	if c.CodeChallenge != "" {
+		if p.str("code_verifier") == "" {
+			return 0, nil, errParam("code_verifier")
+		}
+		if !oauth.VerifyCodeChallenge(c.CodeChallengeMethod, c.CodeChallenge, p.str("code_verifier")) {
+			return 0, nil, errCredential("code_verifier")
+		}
+		if e := b.authClient(c.ClientID, ""); e != nil {
+			return 0, nil, e
+		}
+	} else {
+		if e := p.require("client_secret"); e != nil {
+			return 0, nil, e
+		}
+		if e := b.authClient(c.ClientID, p.str("client_secret")); e != nil {
+			return 0, nil, e
+		}
+	}
+	return http.StatusCreated, b.issueOAuthToken(c.ClientID, c.MaskID, c.Scope, 1), nil
+}
+
+func handleOAuthVerify(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("access_token", "client_id"); e != nil {
+		return 0, nil, e
+	}
+	t, e := b.authOAuthToken(p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	if t.ClientID != p.str("client_id") {
+		return 0, nil, errCredential("client_id")
+	}
+	if e := b.authClient(t.ClientID, p.str("client_secret")); e != nil {
+		return 0, nil, e
+	}
+	if v := p.str("mask_id"); v != "" && v != t.MaskID {
+		return 0, nil, errCredential("mask_id")
+	}
+	return http.StatusOK, t, nil
+}
+
+func handleOAuthRefresh(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	if e := p.require("client_id", "refresh_token"); e != nil {
+		return 0, nil, e
+	}
+	if e := b.authClient(p.str("client_id"), p.str("client_secret")); e != nil {
+		return 0, nil, e
+	}
+	for k, t := range b.state.OAuthTokens {
+		if t.RefreshToken != p.str("refresh_token") || t.ClientID != p.str("client_id") {
+			continue
+		}
+		if int(b.Now().Unix()) > t.RefreshExpires {
+			return 0, nil, errExpired("refresh_token")
+		}
+		delete(b.state.OAuthTokens, k)
+		return http.StatusOK, b.issueOAuthToken(t.ClientID, t.MaskID, t.Scope, t.ObtainedMethod), nil
+	}
+	return 0, nil, errCredential("refresh_token")
+}
+
+func handleOAuthUserInfo(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	t, e := b.authOAuthToken(p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	m, ok := b.state.Masks[t.MaskID]
+	if !ok {
+		return 0, nil, errNotFound("mask_id")
+	}
+	return http.StatusOK, &oauth.OAuthUserInfo{
+		MaskID:      m.MaskId,
+		DisplayName: m.DisplayName,
+		Settings:    m.Settings,
+	}, nil
+}
+
+//notificationChannel picks the first channel the mask allows, starting with the preferred one
+func notificationChannel(u *UserRecord, s user.UserSettingEntity, IsSales bool, Preferred int) int {
+	allowed := func(Method int) bool {
+		switch Method {
+		case common.EMAIL:
+			return u.Email != "" && s.AllowEmailNotifications && (!IsSales || s.AllowSaleEmail)
+		case common.SMS_MESSAGE:
+			return u.Phone != "" && s.AllowSMSNotifications && (!IsSales || s.AllowSaleSMS)
+		case common.PHONE_CALL:
+			return u.Phone != "" && s.AllowCallNotifications && (!IsSales || s.AllowSaleCall)
+		}
+		return false
+	}
+	for _, v := range []int{Preferred, common.EMAIL, common.SMS_MESSAGE, common.PHONE_CALL} {
+		if allowed(v) {
+			return v
+		}
+	}
+	return common.NOT_SENT
+}
+
+//handleOAuthNotification answers with SENT_METHOD NOT_SENT if the user opted out of every channel
+func handleOAuthNotification(b *Backend, args []string, p params) (int, interface{}, *apiError) {
+	t, e := b.authOAuthToken(p.str("access_token"))
+	if e != nil {
+		return 0, nil, e
+	}
+	if e := p.require("title", "content"); e != nil {
+		return 0, nil, e
+	}
+	IsSales := p.boolean("is_sales")
+	if !t.HasScope(oauth.ScopeNotifications) || (IsSales && !t.HasScope(oauth.ScopeContactSales)) {
+		return 0, nil, errPermission("scope")
+	}
+	m, ok := b.state.Masks[t.MaskID]
+	if !ok {
+		return 0, nil, errNotFound("mask_id")
+	}
+	u, ok := b.state.Users[m.UID]
+	if !ok {
+		return 0, nil, errNotFound("user")
+	}
+	preferred, _ := p.integer("preferred_send_methods")
+	method := notificationChannel(u, m.Settings, IsSales, preferred)
+	if method != common.NOT_SENT {
+		n := &Notification{
+			MaskID:   m.MaskId,
+			ClientID: t.ClientID,
+			Title:    p.str("title"),
+			Content:  p.str("content"),
+			IsSales:  IsSales,
+			Method:   method,
+			Sent:     b.Now(),
+		}
+		b.state.Notifications = append(b.state.Notifications, n)
+		if b.OnNotification != nil {
+			b.OnNotification(*n)
+		}
+	}
+	return http.StatusCreated, &common.SENT_METHOD{IotaNum: method}, nil
+}
+
+//handleConsent stands in for the consent page and approves right away.
+//It picks the mask_id query parameter, or else the first mask the user has for the client,
+//and redirects back with error=access_denied if there is none.
+func (b *Backend) handleConsent(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		e := errParam("redirect_uri")
+		writeResult(w, e.StatusCode, e.Result)
+		return
+	}
+	ClientID := q.Get("client_id")
+	if _, ok := b.state.Clients[ClientID]; !ok {
+		e := errNotFound("client_id")
+		writeResult(w, e.StatusCode, e.Result)
+		return
+	}
+
+	var mask *user.MaskIDEntity
+	if id := q.Get("mask_id"); id != "" {
+		mask = b.state.Masks[id]
+	} else {
+		for _, m := range b.state.Masks {
+			if m.ClientID == ClientID && (mask == nil || m.CreateTime < mask.CreateTime) {
+				mask = m
+			}
+		}
+	}
+
+	ret := redirect.Query()
+	if mask == nil || mask.ClientID != ClientID {
+		ret.Set("error", "access_denied")
+	} else {
+		code := randomString(16)
+		var Scope []string
+		if v := q.Get("scope"); v != "" {
+			Scope = strings.Fields(v)
+		}
+		b.state.AuthCodes[code] = &AuthCode{
+			Code:                code,
+			ClientID:            ClientID,
+			MaskID:              mask.MaskId,
+			Scope:               Scope,
+			CodeChallenge:       q.Get("code_challenge"),
+			CodeChallengeMethod: q.Get("code_challenge_type"),
+			Expires:             b.Now().Add(b.CodeTTL),
+		}
+		ret.Set("code", code)
+	}
+	if state := q.Get("state"); state != "" {
+		ret.Set("state", state)
+	}
+	redirect.RawQuery = ret.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
@@ -0,0 +1,45 @@
+//Package ssotest emulates the InteractiveSSO API in process, for tests of code built on this library.
+//
+//It keeps users, masks, tokens and verification codes in memory, answers with the
+//GeneralResult envelope and error codes defined in common, and lets tests read back
+//the verification codes and notifications that would have been sent.
+//
+//	srv := ssotest.NewServer()
+//	defer srv.Close()
+//	a := srv.API()
+//	res, err := a.User().RegisterE("alice", "secret", "captcha", "alice@example.com")
+//	code, _ := srv.LastVeriCode("alice@example.com")
+//	a.User().VerifyEmailE(code)
+package ssotest
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+)
+
+//Server is a Backend behind an httptest.Server
+type Server struct {
+	*httptest.Server
+	*Backend
+}
+
+func NewServer() *Server {
+	b := NewBackend()
+	return &Server{
+		Server:  httptest.NewServer(b),
+		Backend: b,
+	}
+}
+
+//API returns an api.API pointed at s, without retries so injected errors surface right away
+func (s *Server) API() *api.API {
+	return &api.API{
+		Ctx:        context.Background(),
+		HttpClient: s.Client(),
+		Timeout:    10 * time.Second,
+		APIServer:  s.URL,
+	}
+}
@@ -0,0 +1,49 @@
+package ssotest
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//Fixture is seed data for a Backend
+type Fixture struct {
+	Users   []UserRecord        `json:"users"`
+	Clients []Client            `json:"clients"`
+	Masks   []user.MaskIDEntity `json:"masks"`
+}
+
+//Seed adds everything in f, existing entries with the same IDs are replaced
+func (b *Backend) Seed(f *Fixture) {
+	for _, v := range f.Users {
+		b.AddUser(v.UserEntity, v.Password)
+	}
+	for _, v := range f.Clients {
+		b.AddClient(v.ClientID, v.ClientSecret)
+	}
+	for _, v := range f.Masks {
+		b.AddMask(v)
+	}
+}
+
+//Save writes the whole state as JSON, Load reads it back
+func (b *Backend) Save(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(b.state)
+}
+
+//Load replaces the whole state with one written by Save
+func (b *Backend) Load(r io.Reader) error {
+	state := newState()
+	if err := json.NewDecoder(r).Decode(state); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = state
+	return nil
+}
@@ -0,0 +1,183 @@
+//Package tokenstore implements common.TokenStore in memory, in a JSON file and in an AES-GCM encrypted file.
+package tokenstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/internal/fileutil"
+)
+
+var ErrDecrypt = errors.New("token store file can't be decrypted, wrong key?")
+
+//Memory keeps tokens for the lifetime of the process
+type Memory struct {
+	mu     sync.Mutex
+	tokens map[string]json.RawMessage
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		tokens: map[string]json.RawMessage{},
+	}
+}
+
+func (m *Memory) Save(key common.TokenKey, token interface{}) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[key.String()] = data
+	return nil
+}
+
+func (m *Memory) Load(key common.TokenKey, token interface{}) error {
+	m.mu.Lock()
+	data, ok := m.tokens[key.String()]
+	m.mu.Unlock()
+	if !ok {
+		return common.ErrTokenNotFound
+	}
+	return json.Unmarshal(data, token)
+}
+
+func (m *Memory) Delete(key common.TokenKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, key.String())
+	return nil
+}
+
+//File keeps all tokens in one JSON file, rewritten atomically on every change.
+//It is meant for a single process.
+type File struct {
+	Memory
+	path string
+	//seal and open are the identity for a plain file
+	seal func(plain []byte) ([]byte, error)
+	open func(sealed []byte) ([]byte, error)
+}
+
+func identity(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func NewFile(path string) (*File, error) {
+	f := &File{
+		Memory: Memory{tokens: map[string]json.RawMessage{}},
+		path:   path,
+		seal:   identity,
+		open:   identity,
+	}
+	return f, f.read()
+}
+
+//NewEncryptedFile is NewFile with the content sealed by AES-GCM.
+//key must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+func NewEncryptedFile(path string, key []byte) (*File, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{
+		Memory: Memory{tokens: map[string]json.RawMessage{}},
+		path:   path,
+		//The file is nonce || ciphertext
+		seal: func(plain []byte) ([]byte, error) {
+			nonce := make([]byte, gcm.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			return gcm.Seal(nonce, nonce, plain, nil), nil
+		},
+		open: func(sealed []byte) ([]byte, error) {
+			if len(sealed) < gcm.NonceSize() {
+				return nil, ErrDecrypt
+			}
+			plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+			if err != nil {
+				return nil, ErrDecrypt
+			}
+			return plain, nil
+		},
+	}
+	return f, f.read()
+}
+
+func (f *File) read() error {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if data, err = f.open(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &f.tokens)
+}
+
+//flush expects f.mu to be held
+func (f *File) flush() error {
+	data, err := json.Marshal(f.tokens)
+	if err != nil {
+		return err
+	}
+	if data, err = f.seal(data); err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(f.path, data, 0600)
+}
+
+func (f *File) Save(key common.TokenKey, token interface{}) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old, existed := f.tokens[key.String()]
+	f.tokens[key.String()] = data
+	if err := f.flush(); err != nil {
+		if existed {
+			f.tokens[key.String()] = old
+		} else {
+			delete(f.tokens, key.String())
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *File) Delete(key common.TokenKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old, existed := f.tokens[key.String()]
+	if !existed {
+		return nil
+	}
+	delete(f.tokens, key.String())
+	if err := f.flush(); err != nil {
+		f.tokens[key.String()] = old
+		return err
+	}
+	return nil
+}
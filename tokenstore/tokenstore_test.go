@@ -0,0 +1,108 @@
+package tokenstore_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+)
+
+var (
+	key    = bytes.Repeat([]byte{1}, 32)
+	tokenA = common.OAuthTokenKey("app", "m1")
+)
+
+type token struct {
+	AccessToken string `json:"access_token"`
+}
+
+func TestEncryptedFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	f, err := tokenstore.NewEncryptedFile(path, key)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile: %v", err)
+	}
+	if err := f.Save(tokenA, &token{AccessToken: "plaintext-token"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if bytes.Contains(data, []byte("plaintext-token")) {
+		t.Fatal("the file holds the token in plain text")
+	}
+
+	f, err = tokenstore.NewEncryptedFile(path, key)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile after restart: %v", err)
+	}
+	var got token
+	if err := f.Load(tokenA, &got); err != nil || got.AccessToken != "plaintext-token" {
+		t.Fatalf("Load: %+v, %v", got, err)
+	}
+	if err := f.Delete(tokenA); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	f, err = tokenstore.NewEncryptedFile(path, key)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile after restart: %v", err)
+	}
+	if err := f.Load(tokenA, &got); !errors.Is(err, common.ErrTokenNotFound) {
+		t.Fatalf("Load after Delete: got %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestEncryptedFileWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	f, err := tokenstore.NewEncryptedFile(path, key)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile: %v", err)
+	}
+	if err := f.Save(tokenA, &token{AccessToken: "at"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := tokenstore.NewEncryptedFile(path, bytes.Repeat([]byte{2}, 32)); !errors.Is(err, tokenstore.ErrDecrypt) {
+		t.Fatalf("NewEncryptedFile with another key: got %v, want ErrDecrypt", err)
+	}
+	//Neither is a truncated file taken for an empty one
+	data, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path, data[:8], 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := tokenstore.NewEncryptedFile(path, key); !errors.Is(err, tokenstore.ErrDecrypt) {
+		t.Fatalf("NewEncryptedFile of a truncated file: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestEncryptedFileFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens")
+	f, err := tokenstore.NewEncryptedFile(path, key)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile: %v", err)
+	}
+	//A directory in the way makes the final rename fail
+	if err := os.MkdirAll(filepath.Join(path, "in-the-way"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := f.Save(tokenA, &token{AccessToken: "at"}); err == nil {
+		t.Fatal("Save succeeded")
+	}
+	var got token
+	if err := f.Load(tokenA, &got); !errors.Is(err, common.ErrTokenNotFound) {
+		t.Fatalf("Load after a failed Save: got %v, want ErrTokenNotFound", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("the failed Save left %d files behind", len(entries)-1)
+	}
+}
@@ -1,7 +1,10 @@
 package user
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/InteractivePlus/InteractiveSSO-Go/common"
@@ -37,10 +40,10 @@ type MaskIDEntity struct {
 type UserEntity struct {
 	UID           int               `json:"uid"`
 	Username      string            `json:"username"`
-	Nickname      string            `json:"nickname, omitempty"`
-	Signature     string            `json:"signature, omitempty"`
-	Email         string            `json:"email, omitempty"`
-	Phone         string            `json:"phone, omitempty"`
+	Nickname      string            `json:"nickname,omitempty"`
+	Signature     string            `json:"signature,omitempty"`
+	Email         string            `json:"email,omitempty"`
+	Phone         string            `json:"phone,omitempty"`
 	EmailVerified bool              `json:"emailVerified"`
 	PhoneVerified bool              `json:"phoneVerified"`
 	AccountFrozen bool              `json:"accountFrozen"`
@@ -48,59 +51,81 @@ type UserEntity struct {
 }
 
 type User struct {
-	API *api.API
+	API common.Transport
+	//Optional, login tokens are saved to it on login and refresh and deleted on logout
+	Store common.TokenStore
+}
+
+//saveToken writes ret through to u.Store, the token is returned to the caller even if that fails
+func (u *User) saveToken(UID int, ret *LoginRes) error {
+	if u.Store == nil {
+		return nil
+	}
+	return u.Store.Save(common.UserTokenKey(UID), ret)
+}
+
+//LoadToken returns the login token stored for UID, common.ErrTokenNotFound if there is none
+func (u *User) LoadToken(UID int) (*LoginRes, error) {
+	if u.Store == nil {
+		return nil, common.ParamsError
+	}
+	var ret LoginRes
+	if err := u.Store.Load(common.UserTokenKey(UID), &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
 }
 
 type RegisterRes struct {
 	UID                         int    `json:"uid"`
 	Username                    string `json:"username"`
-	Email                       string `json:"email, omitempty"`
-	Phone                       string `json:"phone, omitempty"`
+	Email                       string `json:"email,omitempty"`
+	Phone                       string `json:"phone,omitempty"`
 	PhoneVerificationSentMethod int    `json:"phoneVerificationSentMethod"`
 }
 
 type VerifyEmailRes struct {
 	Username string `json:"username"`
-	Nickname string `json:"nickname, omitempty"`
+	Nickname string `json:"nickname,omitempty"`
 	Email    string `json:"email"`
 }
 
 type VerifyPhoneRes struct {
 	Username string `json:"username"`
-	Nickname string `json:"nickname, omitempty"`
+	Nickname string `json:"nickname,omitempty"`
 	Phone    string `json:"phone"`
 }
 
 type LoginRes struct {
-	AccessToken   string     `json:"access_token, omitempty"`
-	RefreshToken  string     `json:"refresh_token, omitempty"`
-	ExpireTime    int        `json:"expire_time, omitempty"`
-	RefreshExpire int        `json:"refresh_expire, omitempty"`
-	User          UserEntity `json:"user, omitempty"`
-	ErrorReason   int        `json:"errorReason, omitempty"`
-	Email         string     `json:"email, omitempty"`
-	Phone         string     `json:"phone, omitempty"`
-	UID           int        `json:"uid, omitempty"`
+	AccessToken   string     `json:"access_token,omitempty"`
+	RefreshToken  string     `json:"refresh_token,omitempty"`
+	ExpireTime    int        `json:"expire_time,omitempty"`
+	RefreshExpire int        `json:"refresh_expire,omitempty"`
+	User          UserEntity `json:"user,omitempty"`
+	ErrorReason   int        `json:"errorReason,omitempty"`
+	Email         string     `json:"email,omitempty"`
+	Phone         string     `json:"phone,omitempty"`
+	UID           int        `json:"uid,omitempty"`
 }
 
 type ModifyUserPayload struct {
 	UID         int               `json:"uid"`
 	AccessToken string            `json:"access_token"`
-	Nickname    string            `json:"nickname, omitempty"`
-	Signature   string            `json:"signature, omitempty"`
+	Nickname    string            `json:"nickname,omitempty"`
+	Signature   string            `json:"signature,omitempty"`
 	Settings    UserSettingEntity `json:"settings"`
 }
 
 type MaskPayload struct {
 	UID         int               `json:"uid"`
 	AccessToken string            `json:"access_token"`
-	ClientID    string            `json:"client_id, omitempty"`
-	DisplayName string            `json:"display_name, omitempty"`
-	Settings    UserSettingEntity `json:"settings, omitempty"`
+	ClientID    string            `json:"client_id,omitempty"`
+	DisplayName string            `json:"display_name,omitempty"`
+	Settings    UserSettingEntity `json:"settings,omitempty"`
 }
 
 //Opts: email phone
-func (u *User) Register(Username, Password, Captcha_id string, opts ...string) (*RegisterRes, *common.JSONError, error) {
+func (u *User) RegisterContext(ctx context.Context, Username, Password, Captcha_id string, opts ...string) (*RegisterRes, error) {
 	var params = map[string]string{}
 	params["username"] = Username
 	params["password"] = Password
@@ -111,105 +136,158 @@ func (u *User) Register(Username, Password, Captcha_id string, opts ...string) (
 		params["email"] = opts[0]
 		params["phone"] = opts[1]
 	}
-	res, status, err := u.API.PostURL("/user", params)
+	res, status, err := u.API.PostURLContext(ctx, "/user", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret RegisterRes
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 
 }
 
-func (u *User) VerifyEmail(VeriCode string) (*VerifyEmailRes, *common.JSONError, error) {
-	res, status, err := u.API.GetURL(fmt.Sprintf("/vericodes/verifyEmailResult/%s", VeriCode))
+func (u *User) RegisterE(Username, Password, Captcha_id string, opts ...string) (*RegisterRes, error) {
+	return u.RegisterContext(u.API.Context(), Username, Password, Captcha_id, opts...)
+}
+
+//Deprecated: use RegisterE or RegisterContext
+func (u *User) Register(Username, Password, Captcha_id string, opts ...string) (*RegisterRes, *common.JSONError, error) {
+	ret, err := u.RegisterE(Username, Password, Captcha_id, opts...)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) VerifyEmailContext(ctx context.Context, VeriCode string) (*VerifyEmailRes, error) {
+	res, status, err := u.API.GetURLContext(ctx, fmt.Sprintf("/vericodes/verifyEmailResult/%s", url.PathEscape(VeriCode)))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret VerifyEmailRes
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) VerifyPhone(UID int, VeriCode string) (*VerifyPhoneRes, *common.JSONError, error) {
-	res, status, err := u.API.GetURL(fmt.Sprintf("/vericodes/verifyPhoneResult/%s?uid=%d", VeriCode, UID))
+func (u *User) VerifyEmailE(VeriCode string) (*VerifyEmailRes, error) {
+	return u.VerifyEmailContext(u.API.Context(), VeriCode)
+}
+
+//Deprecated: use VerifyEmailE or VerifyEmailContext
+func (u *User) VerifyEmail(VeriCode string) (*VerifyEmailRes, *common.JSONError, error) {
+	ret, err := u.VerifyEmailE(VeriCode)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) VerifyPhoneContext(ctx context.Context, UID int, VeriCode string) (*VerifyPhoneRes, error) {
+	res, status, err := u.API.GetURLContext(ctx, fmt.Sprintf("/vericodes/verifyPhoneResult/%s?uid=%d", url.PathEscape(VeriCode), UID))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret VerifyPhoneRes
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) RequestEmailResend(Email, Captcha_id string) (*common.JSONError, error) {
+func (u *User) VerifyPhoneE(UID int, VeriCode string) (*VerifyPhoneRes, error) {
+	return u.VerifyPhoneContext(u.API.Context(), UID, VeriCode)
+}
+
+//Deprecated: use VerifyPhoneE or VerifyPhoneContext
+func (u *User) VerifyPhone(UID int, VeriCode string) (*VerifyPhoneRes, *common.JSONError, error) {
+	ret, err := u.VerifyPhoneE(UID, VeriCode)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) RequestEmailResendContext(ctx context.Context, Email, Captcha_id string) error {
 	var params = map[string]string{}
 	params["email"] = Email
 	params["captcha_id"] = Captcha_id
-	res, status, err := u.API.PostURL("/vericodes/sendAnotherVerifyEmailRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/sendAnotherVerifyEmailRequest", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, err
+	if status != http.StatusCreated {
+		return common.StatusError(status, res)
 	}
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) RequestPhoneResend(Preferred_send_method int, Phone, Captcha_id string) (*common.SENT_METHOD, *common.JSONError, error) {
+func (u *User) RequestEmailResendE(Email, Captcha_id string) error {
+	return u.RequestEmailResendContext(u.API.Context(), Email, Captcha_id)
+}
+
+//Deprecated: use RequestEmailResendE or RequestEmailResendContext
+func (u *User) RequestEmailResend(Email, Captcha_id string) (*common.JSONError, error) {
+	return common.SplitError(u.RequestEmailResendE(Email, Captcha_id))
+}
+
+func (u *User) RequestPhoneResendContext(ctx context.Context, Preferred_send_method int, Phone, Captcha_id string) (*common.SENT_METHOD, error) {
 	var params = map[string]string{}
 	params["phone"] = Phone
 	params["preferred_send_method"] = strconv.Itoa(Preferred_send_method)
 	params["captcha_id"] = Captcha_id
-	res, status, err := u.API.PostURL("/vericodes/sendAnotherVerifyEmailRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/sendAnotherVerifyEmailRequest", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret common.SENT_METHOD
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
+}
+
+func (u *User) RequestPhoneResendE(Preferred_send_method int, Phone, Captcha_id string) (*common.SENT_METHOD, error) {
+	return u.RequestPhoneResendContext(u.API.Context(), Preferred_send_method, Phone, Captcha_id)
+}
+
+//Deprecated: use RequestPhoneResendE or RequestPhoneResendContext
+func (u *User) RequestPhoneResend(Preferred_send_method int, Phone, Captcha_id string) (*common.SENT_METHOD, *common.JSONError, error) {
+	ret, err := u.RequestPhoneResendE(Preferred_send_method, Phone, Captcha_id)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
 }
 
 //Opts: Username, Phone, Email
 //Leave it ""
-func (u *User) Login(Password, Captcha_id, Username, Phone, Email string) (*LoginRes, *common.JSONError, error) {
+func (u *User) LoginContext(ctx context.Context, Password, Captcha_id, Username, Phone, Email string) (*LoginRes, error) {
 	if Password == "" || Captcha_id == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 	var params = map[string]string{}
 	if Username != "" {
@@ -223,89 +301,147 @@ func (u *User) Login(Password, Captcha_id, Username, Phone, Email string) (*Logi
 		params["email"] = Email
 	}
 
-	res, status, err := u.API.PostURL("/user/token", params)
+	res, status, err := u.API.PostURLContext(ctx, "/user/token", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret LoginRes
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	//A login held back by ErrorReason carries no token, and without a UID there's no key to save it under
+	UID := ret.UID
+	if UID == 0 {
+		UID = ret.User.UID
+	}
+	if ret.AccessToken == "" || UID == 0 {
+		return &ret, nil
+	}
+	return &ret, u.saveToken(UID, &ret)
 
 }
 
-func (u *User) VerifyToken(UID int, AccessToken string) (*common.JSONError, error) {
+func (u *User) LoginE(Password, Captcha_id, Username, Phone, Email string) (*LoginRes, error) {
+	return u.LoginContext(u.API.Context(), Password, Captcha_id, Username, Phone, Email)
+}
+
+//Deprecated: use LoginE or LoginContext
+func (u *User) Login(Password, Captcha_id, Username, Phone, Email string) (*LoginRes, *common.JSONError, error) {
+	ret, err := u.LoginE(Password, Captcha_id, Username, Phone, Email)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) VerifyTokenContext(ctx context.Context, UID int, AccessToken string) error {
 	if AccessToken == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
-	res, status, err := u.API.GetURL(fmt.Sprintf("/user/%d/token/%s/checkTokenResult", UID, AccessToken))
+	res, status, err := u.API.GetURLContext(ctx, fmt.Sprintf("/user/%d/token/%s/checkTokenResult", UID, url.PathEscape(AccessToken)))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) RefreshLoginInfo(UID int, RefreshToken string) (*LoginRes, *common.JSONError, error) {
+func (u *User) VerifyTokenE(UID int, AccessToken string) error {
+	return u.VerifyTokenContext(u.API.Context(), UID, AccessToken)
+}
+
+//Deprecated: use VerifyTokenE or VerifyTokenContext
+func (u *User) VerifyToken(UID int, AccessToken string) (*common.JSONError, error) {
+	return common.SplitError(u.VerifyTokenE(UID, AccessToken))
+}
+
+func (u *User) RefreshLoginInfoContext(ctx context.Context, UID int, RefreshToken string) (*LoginRes, error) {
 	if RefreshToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 
-	res, status, err := u.API.GetURL(fmt.Sprintf("/user/%d/token/refreshResult?refresh_token=%s", UID, RefreshToken))
+	res, status, err := u.API.GetURLContext(ctx, fmt.Sprintf("/user/%d/token/refreshResult?refresh_token=%s", UID, url.QueryEscape(RefreshToken)))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret LoginRes
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	//Not every response repeats the refresh token
+	if ret.RefreshToken == "" {
+		ret.RefreshToken = RefreshToken
+	}
+	if ret.AccessToken == "" {
+		return &ret, nil
+	}
+	return &ret, u.saveToken(UID, &ret)
 }
 
-func (u *User) Logout(UID int, AccessToken string) (*common.JSONError, error) {
+func (u *User) RefreshLoginInfoE(UID int, RefreshToken string) (*LoginRes, error) {
+	return u.RefreshLoginInfoContext(u.API.Context(), UID, RefreshToken)
+}
+
+//Deprecated: use RefreshLoginInfoE or RefreshLoginInfoContext
+func (u *User) RefreshLoginInfo(UID int, RefreshToken string) (*LoginRes, *common.JSONError, error) {
+	ret, err := u.RefreshLoginInfoE(UID, RefreshToken)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) LogoutContext(ctx context.Context, UID int, AccessToken string) error {
 	if AccessToken == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
-	res, status, err := u.API.DeleteURL(fmt.Sprintf("/user/%d/token/%s", UID, AccessToken))
+	res, status, err := u.API.DeleteURLContext(ctx, fmt.Sprintf("/user/%d/token/%s", UID, url.PathEscape(AccessToken)))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP204NOCONTENT {
-		return nil, err
+	if status != http.StatusNoContent {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	if u.Store != nil {
+		return u.Store.Delete(common.UserTokenKey(UID))
+	}
+	return nil
 
 }
 
-func (u *User) RequestEmailVeriCode(UID int, AccessToken, NewEmail string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+func (u *User) LogoutE(UID int, AccessToken string) error {
+	return u.LogoutContext(u.API.Context(), UID, AccessToken)
+}
+
+//Deprecated: use LogoutE or LogoutContext
+func (u *User) Logout(UID int, AccessToken string) (*common.JSONError, error) {
+	return common.SplitError(u.LogoutE(UID, AccessToken))
+}
+
+func (u *User) RequestEmailVeriCodeContext(ctx context.Context, UID int, AccessToken, NewEmail string, Preferred_send_method int) (*common.SENT_METHOD, error) {
 	if AccessToken == "" || NewEmail == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 
 	var params = map[string]string{}
@@ -313,25 +449,36 @@ func (u *User) RequestEmailVeriCode(UID int, AccessToken, NewEmail string, Prefe
 	params["preferred_send_method"] = strconv.Itoa(Preferred_send_method)
 	params["new_email"] = NewEmail
 	params["access_token"] = AccessToken
-	res, status, err := u.API.PostURL("/vericodes/changeEmailAddrRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/changeEmailAddrRequest", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret common.SENT_METHOD
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) RequestPhoneVeriCode(UID int, AccessToken, NewPhone string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+func (u *User) RequestEmailVeriCodeE(UID int, AccessToken, NewEmail string, Preferred_send_method int) (*common.SENT_METHOD, error) {
+	return u.RequestEmailVeriCodeContext(u.API.Context(), UID, AccessToken, NewEmail, Preferred_send_method)
+}
+
+//Deprecated: use RequestEmailVeriCodeE or RequestEmailVeriCodeContext
+func (u *User) RequestEmailVeriCode(UID int, AccessToken, NewEmail string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+	ret, err := u.RequestEmailVeriCodeE(UID, AccessToken, NewEmail, Preferred_send_method)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) RequestPhoneVeriCodeContext(ctx context.Context, UID int, AccessToken, NewPhone string, Preferred_send_method int) (*common.SENT_METHOD, error) {
 	if AccessToken == "" || NewPhone == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 
 	var params = map[string]string{}
@@ -339,144 +486,202 @@ func (u *User) RequestPhoneVeriCode(UID int, AccessToken, NewPhone string, Prefe
 	params["preferred_send_method"] = strconv.Itoa(Preferred_send_method)
 	params["new_email"] = NewPhone
 	params["access_token"] = AccessToken
-	res, status, err := u.API.PostURL("/vericodes/changePhoneNumberRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/changePhoneNumberRequest", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret common.SENT_METHOD
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) AddEmail(UID int, AccessToken, NewEmail string) (*common.JSONError, error) {
+func (u *User) RequestPhoneVeriCodeE(UID int, AccessToken, NewPhone string, Preferred_send_method int) (*common.SENT_METHOD, error) {
+	return u.RequestPhoneVeriCodeContext(u.API.Context(), UID, AccessToken, NewPhone, Preferred_send_method)
+}
+
+//Deprecated: use RequestPhoneVeriCodeE or RequestPhoneVeriCodeContext
+func (u *User) RequestPhoneVeriCode(UID int, AccessToken, NewPhone string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+	ret, err := u.RequestPhoneVeriCodeE(UID, AccessToken, NewPhone, Preferred_send_method)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) AddEmailContext(ctx context.Context, UID int, AccessToken, NewEmail string) error {
 	if AccessToken == "" || NewEmail == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["new_email"] = NewEmail
 	params["access_token"] = AccessToken
-	res, status, err := u.API.PatchURL("/user/email", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/email", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) ModifyEmail(UID int, VeriCode string) (*common.JSONError, error) {
+func (u *User) AddEmailE(UID int, AccessToken, NewEmail string) error {
+	return u.AddEmailContext(u.API.Context(), UID, AccessToken, NewEmail)
+}
+
+//Deprecated: use AddEmailE or AddEmailContext
+func (u *User) AddEmail(UID int, AccessToken, NewEmail string) (*common.JSONError, error) {
+	return common.SplitError(u.AddEmailE(UID, AccessToken, NewEmail))
+}
+
+func (u *User) ModifyEmailContext(ctx context.Context, UID int, VeriCode string) error {
 	if VeriCode == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["veriCode"] = VeriCode
-	res, status, err := u.API.PatchURL("/user/email", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/email", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) AddPhone(UID int, AccessToken, NewPhone string) (*common.JSONError, error) {
+func (u *User) ModifyEmailE(UID int, VeriCode string) error {
+	return u.ModifyEmailContext(u.API.Context(), UID, VeriCode)
+}
+
+//Deprecated: use ModifyEmailE or ModifyEmailContext
+func (u *User) ModifyEmail(UID int, VeriCode string) (*common.JSONError, error) {
+	return common.SplitError(u.ModifyEmailE(UID, VeriCode))
+}
+
+func (u *User) AddPhoneContext(ctx context.Context, UID int, AccessToken, NewPhone string) error {
 	if AccessToken == "" || NewPhone == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["new_email"] = NewPhone
 	params["access_token"] = AccessToken
-	res, status, err := u.API.PatchURL("/user/phoneNum", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/phoneNum", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) ModifyPhone(UID int, VeriCode string) (*common.JSONError, error) {
+func (u *User) AddPhoneE(UID int, AccessToken, NewPhone string) error {
+	return u.AddPhoneContext(u.API.Context(), UID, AccessToken, NewPhone)
+}
+
+//Deprecated: use AddPhoneE or AddPhoneContext
+func (u *User) AddPhone(UID int, AccessToken, NewPhone string) (*common.JSONError, error) {
+	return common.SplitError(u.AddPhoneE(UID, AccessToken, NewPhone))
+}
+
+func (u *User) ModifyPhoneContext(ctx context.Context, UID int, VeriCode string) error {
 	if VeriCode == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["veriCode"] = VeriCode
-	res, status, err := u.API.PatchURL("/user/phoneNum", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/phoneNum", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) RequestChangePasswordVeriCode(UID int, AccessToken string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+func (u *User) ModifyPhoneE(UID int, VeriCode string) error {
+	return u.ModifyPhoneContext(u.API.Context(), UID, VeriCode)
+}
+
+//Deprecated: use ModifyPhoneE or ModifyPhoneContext
+func (u *User) ModifyPhone(UID int, VeriCode string) (*common.JSONError, error) {
+	return common.SplitError(u.ModifyPhoneE(UID, VeriCode))
+}
+
+func (u *User) RequestChangePasswordVeriCodeContext(ctx context.Context, UID int, AccessToken string, Preferred_send_method int) (*common.SENT_METHOD, error) {
 	if AccessToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["preferred_send_method"] = strconv.Itoa(Preferred_send_method)
 	params["access_token"] = AccessToken
-	res, status, err := u.API.PostURL("/vericodes/changePasswordRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/changePasswordRequest", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret common.SENT_METHOD
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) RequestResetPasswordVeriCode(UID int, AccessToken string, Preferred_send_method int, Username, Phone, Email string) (*common.SENT_METHOD, *common.JSONError, error) {
+func (u *User) RequestChangePasswordVeriCodeE(UID int, AccessToken string, Preferred_send_method int) (*common.SENT_METHOD, error) {
+	return u.RequestChangePasswordVeriCodeContext(u.API.Context(), UID, AccessToken, Preferred_send_method)
+}
+
+//Deprecated: use RequestChangePasswordVeriCodeE or RequestChangePasswordVeriCodeContext
+func (u *User) RequestChangePasswordVeriCode(UID int, AccessToken string, Preferred_send_method int) (*common.SENT_METHOD, *common.JSONError, error) {
+	ret, err := u.RequestChangePasswordVeriCodeE(UID, AccessToken, Preferred_send_method)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) RequestResetPasswordVeriCodeContext(ctx context.Context, UID int, AccessToken string, Preferred_send_method int, Username, Phone, Email string) (*common.SENT_METHOD, error) {
 	if AccessToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 
 	var params = map[string]string{}
@@ -495,49 +700,69 @@ func (u *User) RequestResetPasswordVeriCode(UID int, AccessToken string, Preferr
 		params["email"] = Email
 	}
 
-	res, status, err := u.API.PostURL("/vericodes/changePasswordRequest", params)
+	res, status, err := u.API.PostURLContext(ctx, "/vericodes/changePasswordRequest", params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret common.SENT_METHOD
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) ChangePassword(UID int, NewPassword, VeriCode string) (*common.JSONError, error) {
+func (u *User) RequestResetPasswordVeriCodeE(UID int, AccessToken string, Preferred_send_method int, Username, Phone, Email string) (*common.SENT_METHOD, error) {
+	return u.RequestResetPasswordVeriCodeContext(u.API.Context(), UID, AccessToken, Preferred_send_method, Username, Phone, Email)
+}
+
+//Deprecated: use RequestResetPasswordVeriCodeE or RequestResetPasswordVeriCodeContext
+func (u *User) RequestResetPasswordVeriCode(UID int, AccessToken string, Preferred_send_method int, Username, Phone, Email string) (*common.SENT_METHOD, *common.JSONError, error) {
+	ret, err := u.RequestResetPasswordVeriCodeE(UID, AccessToken, Preferred_send_method, Username, Phone, Email)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) ChangePasswordContext(ctx context.Context, UID int, NewPassword, VeriCode string) error {
 	if VeriCode == "" || NewPassword == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["veriCode"] = VeriCode
 	params["new_password"] = NewPassword
-	res, status, err := u.API.PatchURL("/user/password", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/password", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) ResetPassword(UID int, NewPassword, VeriCode string, Username, Phone, Email string) (*common.JSONError, error) {
+func (u *User) ChangePasswordE(UID int, NewPassword, VeriCode string) error {
+	return u.ChangePasswordContext(u.API.Context(), UID, NewPassword, VeriCode)
+}
+
+//Deprecated: use ChangePasswordE or ChangePasswordContext
+func (u *User) ChangePassword(UID int, NewPassword, VeriCode string) (*common.JSONError, error) {
+	return common.SplitError(u.ChangePasswordE(UID, NewPassword, VeriCode))
+}
+
+func (u *User) ResetPasswordContext(ctx context.Context, UID int, NewPassword, VeriCode string, Username, Phone, Email string) error {
 	if VeriCode == "" || NewPassword == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
 	var params = map[string]string{}
@@ -556,24 +781,33 @@ func (u *User) ResetPassword(UID int, NewPassword, VeriCode string, Username, Ph
 		params["email"] = Email
 	}
 
-	res, status, err := u.API.PatchURL("/user/password", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/password", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) ModifyUserInfo(UID int, AccessToken, Nickname, Signature string, Settings *UserSettingEntity) (*common.JSONError, error) {
+func (u *User) ResetPasswordE(UID int, NewPassword, VeriCode string, Username, Phone, Email string) error {
+	return u.ResetPasswordContext(u.API.Context(), UID, NewPassword, VeriCode, Username, Phone, Email)
+}
+
+//Deprecated: use ResetPasswordE or ResetPasswordContext
+func (u *User) ResetPassword(UID int, NewPassword, VeriCode string, Username, Phone, Email string) (*common.JSONError, error) {
+	return common.SplitError(u.ResetPasswordE(UID, NewPassword, VeriCode, Username, Phone, Email))
+}
+
+func (u *User) ModifyUserInfoContext(ctx context.Context, UID int, AccessToken, Nickname, Signature string, Settings *UserSettingEntity) error {
 	if AccessToken == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 	params := &ModifyUserPayload{
 		UID:         UID,
@@ -590,56 +824,76 @@ func (u *User) ModifyUserInfo(UID int, AccessToken, Nickname, Signature string,
 		params.Settings = *Settings
 	}
 
-	res, status, err := u.API.PatchURL("/user/password", params)
+	res, status, err := u.API.PatchURLContext(ctx, "/user/password", params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP200OK {
-		return nil, err
+	if status != http.StatusOK {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (u *User) ListMask(UID int, AccessToken string, opts ...string) (*MaskIDEntity, *common.JSONError, error) {
+func (u *User) ModifyUserInfoE(UID int, AccessToken, Nickname, Signature string, Settings *UserSettingEntity) error {
+	return u.ModifyUserInfoContext(u.API.Context(), UID, AccessToken, Nickname, Signature, Settings)
+}
+
+//Deprecated: use ModifyUserInfoE or ModifyUserInfoContext
+func (u *User) ModifyUserInfo(UID int, AccessToken, Nickname, Signature string, Settings *UserSettingEntity) (*common.JSONError, error) {
+	return common.SplitError(u.ModifyUserInfoE(UID, AccessToken, Nickname, Signature, Settings))
+}
+
+func (u *User) ListMaskContext(ctx context.Context, UID int, AccessToken string, opts ...string) (*MaskIDEntity, error) {
 	if AccessToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 	var URL string
 	if len(opts) > 0 {
-		URL = fmt.Sprintf("/masks/%s", opts[0])
+		URL = fmt.Sprintf("/masks/%s", url.PathEscape(opts[0]))
 	} else {
 		URL = "/masks"
 	}
 	var params = map[string]string{}
 	params["uid"] = strconv.Itoa(UID)
 	params["access_token"] = AccessToken
-	res, status, err := u.API.GetURLWithParams(URL, params)
+	res, status, err := u.API.GetURLWithParamsContext(ctx, URL, params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret MaskIDEntity
 
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 
 }
 
-func (u *User) AddMask(UID int, AccessToken, ClientID, DisplayName string, Settings UserSettingEntity) (*MaskIDEntity, *common.JSONError, error) {
+func (u *User) ListMaskE(UID int, AccessToken string, opts ...string) (*MaskIDEntity, error) {
+	return u.ListMaskContext(u.API.Context(), UID, AccessToken, opts...)
+}
+
+//Deprecated: use ListMaskE or ListMaskContext
+func (u *User) ListMask(UID int, AccessToken string, opts ...string) (*MaskIDEntity, *common.JSONError, error) {
+	ret, err := u.ListMaskE(UID, AccessToken, opts...)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) AddMaskContext(ctx context.Context, UID int, AccessToken, ClientID, DisplayName string, Settings UserSettingEntity) (*MaskIDEntity, error) {
 	if AccessToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 	params := &MaskPayload{
 		UID:         UID,
@@ -648,25 +902,36 @@ func (u *User) AddMask(UID int, AccessToken, ClientID, DisplayName string, Setti
 		Settings:    Settings,
 	}
 
-	res, status, err := u.API.PostURL(fmt.Sprintf("/masks/%s", ClientID), params)
+	res, status, err := u.API.PostURLContext(ctx, fmt.Sprintf("/masks/%s", url.PathEscape(ClientID)), params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP201CREATED {
-		return nil, nil, err
+	if status != http.StatusCreated {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret MaskIDEntity
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) ModifyMask(UID int, MaskID, AccessToken, ClientID, DisplayName string, Settings *UserSettingEntity) (*MaskIDEntity, *common.JSONError, error) {
+func (u *User) AddMaskE(UID int, AccessToken, ClientID, DisplayName string, Settings UserSettingEntity) (*MaskIDEntity, error) {
+	return u.AddMaskContext(u.API.Context(), UID, AccessToken, ClientID, DisplayName, Settings)
+}
+
+//Deprecated: use AddMaskE or AddMaskContext
+func (u *User) AddMask(UID int, AccessToken, ClientID, DisplayName string, Settings UserSettingEntity) (*MaskIDEntity, *common.JSONError, error) {
+	ret, err := u.AddMaskE(UID, AccessToken, ClientID, DisplayName, Settings)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) ModifyMaskContext(ctx context.Context, UID int, MaskID, AccessToken, ClientID, DisplayName string, Settings *UserSettingEntity) (*MaskIDEntity, error) {
 	if AccessToken == "" {
-		return nil, nil, common.ParamsError
+		return nil, common.ParamsError
 	}
 	params := &MaskPayload{
 		UID:         UID,
@@ -681,39 +946,59 @@ func (u *User) ModifyMask(UID int, MaskID, AccessToken, ClientID, DisplayName st
 		params.Settings = *Settings
 	}
 
-	res, status, err := u.API.PatchURL(fmt.Sprintf("/masks/%s", MaskID), params)
+	res, status, err := u.API.PatchURLContext(ctx, fmt.Sprintf("/masks/%s", url.PathEscape(MaskID)), params)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if status != common.HTTP200OK {
-		return nil, nil, err
+	if status != http.StatusOK {
+		return nil, common.StatusError(status, res)
 	}
 
 	var ret MaskIDEntity
-	if err := common.ProcessResult(res, &ret); err != nil {
-		return nil, err, nil
+	if err := common.DecodeResult(res, &ret); err != nil {
+		return nil, err
 	}
 
-	return &ret, nil, nil
+	return &ret, nil
 }
 
-func (u *User) DeleteMask(UID int, MaskID, AccessToken string) (*common.JSONError, error) {
+func (u *User) ModifyMaskE(UID int, MaskID, AccessToken, ClientID, DisplayName string, Settings *UserSettingEntity) (*MaskIDEntity, error) {
+	return u.ModifyMaskContext(u.API.Context(), UID, MaskID, AccessToken, ClientID, DisplayName, Settings)
+}
+
+//Deprecated: use ModifyMaskE or ModifyMaskContext
+func (u *User) ModifyMask(UID int, MaskID, AccessToken, ClientID, DisplayName string, Settings *UserSettingEntity) (*MaskIDEntity, *common.JSONError, error) {
+	ret, err := u.ModifyMaskE(UID, MaskID, AccessToken, ClientID, DisplayName, Settings)
+	jsonErr, err := common.SplitError(err)
+	return ret, jsonErr, err
+}
+
+func (u *User) DeleteMaskContext(ctx context.Context, UID int, MaskID, AccessToken string) error {
 	if AccessToken == "" || MaskID == "" {
-		return nil, common.ParamsError
+		return common.ParamsError
 	}
 
-	res, status, err := u.API.DeleteURL(fmt.Sprintf("/masks/%s", MaskID))
+	res, status, err := u.API.DeleteURLContext(ctx, fmt.Sprintf("/masks/%s", url.PathEscape(MaskID)))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if status != common.HTTP204NOCONTENT {
-		return nil, err
+	if status != http.StatusNoContent {
+		return common.StatusError(status, res)
 	}
 
-	if err := common.FetchError(res); err != nil {
-		return err, nil
+	if err := common.DecodeError(res); err != nil {
+		return err
 	}
 
-	return nil, nil
+	return nil
+
+}
 
+func (u *User) DeleteMaskE(UID int, MaskID, AccessToken string) error {
+	return u.DeleteMaskContext(u.API.Context(), UID, MaskID, AccessToken)
+}
+
+//Deprecated: use DeleteMaskE or DeleteMaskContext
+func (u *User) DeleteMask(UID int, MaskID, AccessToken string) (*common.JSONError, error) {
+	return common.SplitError(u.DeleteMaskE(UID, MaskID, AccessToken))
 }
@@ -0,0 +1,98 @@
+package user_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/InteractivePlus/InteractiveSSO-Go/api"
+	"github.com/InteractivePlus/InteractiveSSO-Go/common"
+	"github.com/InteractivePlus/InteractiveSSO-Go/tokenstore"
+	"github.com/InteractivePlus/InteractiveSSO-Go/user"
+)
+
+//loginServer answers every request with data as the result of a login
+func loginServer(t *testing.T, data string) *user.User {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(common.GeneralResult{
+			Data: json.RawMessage(data),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return &user.User{
+		API: &api.API{
+			HttpClient: srv.Client(),
+			APIServer:  srv.URL,
+		},
+		Store: tokenstore.NewMemory(),
+	}
+}
+
+func TestLoginSavesToken(t *testing.T) {
+	us := loginServer(t, `{"access_token":"at","refresh_token":"rt","uid":1}`)
+
+	res, err := us.LoginE("secret", "captcha", "alice", "", "")
+	if err != nil {
+		t.Fatalf("LoginE: %v", err)
+	}
+	stored, err := us.LoadToken(1)
+	if err != nil {
+		t.Fatalf("LoadToken: %v", err)
+	}
+	if stored.AccessToken != res.AccessToken {
+		t.Fatalf("stored access token %q, want %q", stored.AccessToken, res.AccessToken)
+	}
+}
+
+func TestLoginWithoutTokenSavesNothing(t *testing.T) {
+	//The SSO answers an unverified login with a reason instead of a token
+	us := loginServer(t, `{"errorReason":1,"uid":1}`)
+
+	res, err := us.LoginE("secret", "captcha", "alice", "", "")
+	if err != nil {
+		t.Fatalf("LoginE: %v", err)
+	}
+	if res.ErrorReason != user.EMAIL_NOT_VERIFIED {
+		t.Fatalf("ErrorReason is %d, want EMAIL_NOT_VERIFIED", res.ErrorReason)
+	}
+	if _, err := us.LoadToken(1); !errors.Is(err, common.ErrTokenNotFound) {
+		t.Fatalf("LoadToken: got %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestMaskPathsEscaped(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.Write([]byte(`{"errorCode":0}`))
+	}))
+	defer srv.Close()
+	us := &user.User{
+		API: &api.API{
+			HttpClient: srv.Client(),
+			APIServer:  srv.URL,
+		},
+	}
+
+	//An ID reaching into another endpoint
+	const id = "../user/1?uid=2"
+	ctx := us.API.Context()
+	us.ListMaskContext(ctx, 1, "at", id)
+	us.AddMaskContext(ctx, 1, "at", id, "name", user.UserSettingEntity{})
+	us.ModifyMaskContext(ctx, 1, id, "at", "app", "name", nil)
+	us.DeleteMaskContext(ctx, 1, id, "at")
+	want := "/masks/" + url.PathEscape(id)
+	if len(paths) != 4 {
+		t.Fatalf("%d requests, want 4", len(paths))
+	}
+	for i, got := range paths {
+		if got != want {
+			t.Errorf("request %d went to %s, want %s", i, got, want)
+		}
+	}
+}